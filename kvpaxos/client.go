@@ -1,13 +1,19 @@
 package kvpaxos
 
+import "context"
 import "net/rpc"
 import "time"
 import "math/rand"
+import "sync"
 
 type Clerk struct {
+	mu      sync.Mutex // one request at a time, so RequestIDs reach the servers in order
 	servers []string
 	// You will have to modify this struct.
-	id int
+	id        int
+	requestID int           // of the last request sent
+	leader    int           // index of the server to try first
+	timeout   time.Duration // how long to wait for any one server
 }
 
 func MakeClerk(servers []string) *Clerk {
@@ -15,9 +21,21 @@ func MakeClerk(servers []string) *Clerk {
 	ck.servers = servers
 	// You'll have to add code here.
 	ck.id = rand.Int()
+	ck.timeout = 2 * time.Second
 	return ck
 }
 
+//
+// how long to wait for one server's reply before trying
+// the next; requests that take longer, like writes during
+// a partition, are retried.
+//
+func (ck *Clerk) SetTimeout(timeout time.Duration) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.timeout = timeout
+}
+
 //
 // call() sends an RPC to the rpcname handler on server srv
 // with arguments args, waits for the reply, and leaves the
@@ -49,50 +67,408 @@ func call(srv string, rpcname string,
 	return false
 }
 
+//
+// call() that gives up after ck.timeout, or when ctx ends,
+// so one replica stuck waiting on paxos doesn't hold up the
+// rest. callers declare a new reply for each server they try.
+//
+func (ck *Clerk) callTimeout(ctx context.Context, srv string, rpcname string,
+	args interface{}, reply interface{}) bool {
+	done := make(chan bool, 1)
+	go func() {
+		done <- call(srv, rpcname, args, reply)
+	}()
+	timer := time.NewTimer(ck.timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-done:
+		return ok
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//
+// ErrTimeout if ctx's deadline passed while we went round
+// the replicas, else ctx.Err(), e.g. context.Canceled.
+//
+func ctxErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+//
+// wait a little before the next pass over the servers,
+// or return ctxErr() if ctx ends first.
+//
+func pause(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctxErr(ctx)
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+//
+// the order to try the servers in: the one that last
+// answered, or that it named as leader, first.
+//
+func (ck *Clerk) order() []int {
+	order := make([]int, 0, len(ck.servers))
+	for i := range ck.servers {
+		order = append(order, (ck.leader+i)%len(ck.servers))
+	}
+	return order
+}
+
+//
+// remember which server to try first: the leader server i
+// named in its reply, or else i itself.
+//
+func (ck *Clerk) heard(i int, leader int) {
+	if leader >= 0 && leader < len(ck.servers) {
+		ck.leader = leader
+	} else {
+		ck.leader = i
+	}
+}
+
 //
 // fetch the current value for a key.
 // returns "" if the key does not exist.
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
+	value, _ := ck.GetContext(context.Background(), key)
+	return value
+}
+
+//
+// like Get, but gives up when ctx ends, returning ErrTimeout
+// if its deadline passed. returns ErrNoKey if the key does
+// not exist.
+//
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, error) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.requestID++
 	args := &GetArgs{}
-	args.RequestID = rand.Int()
+	args.RequestID = ck.requestID
 	args.ClientID = ck.id
 	args.Key = key
 
 	for {
-		// try each known server.
-		for _, srv := range ck.servers {
+		// try each known server, the last good one first.
+		for _, i := range ck.order() {
+			if ctx.Err() != nil {
+				return "", ctxErr(ctx)
+			}
 			var reply GetReply
-			ok := call(srv, "KVPaxos.Get", args, &reply)
+			ok := ck.callTimeout(ctx, ck.servers[i], "KVPaxos.Get", args, &reply)
 			if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-				return reply.Value
+				ck.heard(i, reply.Leader)
+				if reply.Err == ErrNoKey {
+					return "", ErrNoKey
+				}
+				return reply.Value, nil
 			}
 		}
-		time.Sleep(100 * time.Millisecond)
+		if err := pause(ctx); err != nil {
+			return "", err
+		}
 	}
-	return ""
 }
 
 //
-// set the value for a key.
-// keeps trying until it succeeds.
+// send a write to the servers, and return the key's
+// previous value. keeps trying until it succeeds or ctx
+// ends; a write given up on may still happen later.
 //
-func (ck *Clerk) Put(key string, value string) {
+func (ck *Clerk) write(ctx context.Context, op string, key string, value string, expected string) (string, error) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.requestID++
 	args := &PutArgs{}
-	args.RequestID = rand.Int()
+	args.RequestID = ck.requestID
 	args.ClientID = ck.id
 	args.Key = key
 	args.Value = value
+	args.Op = op
+	args.Expected = expected
 
 	for {
-		for _, srv := range ck.servers {
+		for _, i := range ck.order() {
+			if ctx.Err() != nil {
+				return "", ctxErr(ctx)
+			}
 			var reply PutReply
-			ok := call(srv, "KVPaxos.Put", args, &reply)
+			ok := ck.callTimeout(ctx, ck.servers[i], "KVPaxos.Put", args, &reply)
 			if ok && reply.Err == OK {
-				return
+				ck.heard(i, reply.Leader)
+				return reply.PreviousValue, nil
+			}
+		}
+		if err := pause(ctx); err != nil {
+			return "", err
+		}
+	}
+}
+
+//
+// set the value for a key.
+// keeps trying until it succeeds.
+//
+func (ck *Clerk) Put(key string, value string) {
+	ck.PutContext(context.Background(), key, value)
+}
+
+func (ck *Clerk) PutContext(ctx context.Context, key string, value string) error {
+	_, err := ck.write(ctx, PUT, key, value, "")
+	return err
+}
+
+//
+// add suffix to the end of key's value; a missing
+// key is treated as "".
+//
+func (ck *Clerk) Append(key string, suffix string) {
+	ck.AppendContext(context.Background(), key, suffix)
+}
+
+func (ck *Clerk) AppendContext(ctx context.Context, key string, suffix string) error {
+	_, err := ck.write(ctx, APPEND, key, suffix, "")
+	return err
+}
+
+//
+// set key to hash(previous value + value), and return
+// the previous value.
+//
+func (ck *Clerk) PutHash(key string, value string) string {
+	previous, _ := ck.PutHashContext(context.Background(), key, value)
+	return previous
+}
+
+func (ck *Clerk) PutHashContext(ctx context.Context, key string, value string) (string, error) {
+	return ck.write(ctx, PUTHASH, key, value, "")
+}
+
+//
+// set key to value if it currently holds expected (a
+// missing key holds ""), and return the value it held.
+// the swap happened iff the result equals expected.
+//
+func (ck *Clerk) CAS(key string, expected string, value string) string {
+	previous, _ := ck.CASContext(context.Background(), key, expected, value)
+	return previous
+}
+
+func (ck *Clerk) CASContext(ctx context.Context, key string, expected string, value string) (string, error) {
+	return ck.write(ctx, CAS, key, value, expected)
+}
+
+//
+// remove key; later Gets return "".
+//
+func (ck *Clerk) Delete(key string) {
+	ck.DeleteContext(context.Background(), key)
+}
+
+func (ck *Clerk) DeleteContext(ctx context.Context, key string) error {
+	_, err := ck.write(ctx, DELETE, key, "", "")
+	return err
+}
+
+//
+// if every check holds, apply all of writes as one atomic
+// step and return true; otherwise change nothing and return
+// false. keeps trying until the servers answer.
+//
+func (ck *Clerk) Txn(checks []Check, writes []Write) bool {
+	applied, _ := ck.TxnContext(context.Background(), checks, writes)
+	return applied
+}
+
+//
+// like Txn, but gives up when ctx ends. a failed check is
+// not an error: it returns false, nil.
+//
+func (ck *Clerk) TxnContext(ctx context.Context, checks []Check, writes []Write) (bool, error) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.requestID++
+	args := &TxnArgs{}
+	args.RequestID = ck.requestID
+	args.ClientID = ck.id
+	args.Checks = checks
+	args.Writes = writes
+
+	for {
+		for _, i := range ck.order() {
+			if ctx.Err() != nil {
+				return false, ctxErr(ctx)
 			}
+			var reply TxnReply
+			ok := ck.callTimeout(ctx, ck.servers[i], "KVPaxos.Txn", args, &reply)
+			if ok && (reply.Err == OK || reply.Err == ErrCheckFailed) {
+				ck.heard(i, reply.Leader)
+				return reply.Err == OK, nil
+			}
+		}
+		if err := pause(ctx); err != nil {
+			return false, err
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
 }
+
+//
+// one page of the pairs with start <= key < end, in key
+// order, and a token for the next page ("" after the last
+// one). end == "" means no upper bound; pass token == ""
+// for the first page.
+//
+func (ck *Clerk) Scan(start string, end string, limit int, token string) ([]KeyValue, string) {
+	kvs, next, _ := ck.ScanContext(context.Background(), start, end, limit, token)
+	return kvs, next
+}
+
+func (ck *Clerk) ScanContext(ctx context.Context, start string, end string, limit int, token string) ([]KeyValue, string, error) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.requestID++
+	args := &ScanArgs{}
+	args.RequestID = ck.requestID
+	args.ClientID = ck.id
+	args.Start = start
+	args.End = end
+	args.Limit = limit
+	args.Token = token
+
+	for {
+		for _, i := range ck.order() {
+			if ctx.Err() != nil {
+				return nil, "", ctxErr(ctx)
+			}
+			var reply ScanReply
+			ok := ck.callTimeout(ctx, ck.servers[i], "KVPaxos.Scan", args, &reply)
+			if ok && reply.Err == OK {
+				ck.heard(i, reply.Leader)
+				return reply.KeyValues, reply.Token, nil
+			}
+		}
+		if err := pause(ctx); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+//
+// every pair whose key starts with prefix, in key order.
+//
+func (ck *Clerk) ListPrefix(prefix string) []KeyValue {
+	all, _ := ck.ListPrefixContext(context.Background(), prefix)
+	return all
+}
+
+func (ck *Clerk) ListPrefixContext(ctx context.Context, prefix string) ([]KeyValue, error) {
+	end := prefixEnd(prefix)
+	all := []KeyValue{}
+	token := ""
+	for {
+		kvs, next, err := ck.ScanContext(ctx, prefix, end, 0, token)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, kvs...)
+		if next == "" {
+			return all, nil
+		}
+		token = next
+	}
+}
+
+//
+// the smallest key greater than every key starting with
+// prefix, or "" if there isn't one.
+//
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+//
+// every write to key (or, if prefix is true, to any key
+// starting with key) decided in instance fromSeq or later,
+// in log order, until cancel() is called. to resume after
+// a restart, watch again from the last Event's Seq + 1.
+// the channel is closed if no server still remembers the
+// writes from fromSeq on.
+//
+func (ck *Clerk) Watch(key string, prefix bool, fromSeq int) (<-chan Event, func()) {
+	ch := make(chan Event)
+	done := make(chan bool)
+	var once sync.Once
+	cancel := func() { once.Do(func() { close(done) }) }
+
+	go func() {
+		defer close(ch)
+		args := &WatchArgs{key, prefix, fromSeq}
+		first := 0 // the server to ask first
+		for {
+			compacted := 0
+			answered := false
+			for k := range ck.servers {
+				i := (first + k) % len(ck.servers)
+				var reply WatchReply
+				if !call(ck.servers[i], "KVPaxos.Watch", args, &reply) {
+					continue
+				}
+				if reply.Err == ErrCompacted {
+					compacted++
+					continue
+				}
+				for _, e := range reply.Events {
+					select {
+					case ch <- e:
+					case <-done:
+						return
+					}
+				}
+				// a server that waited and got nowhere may be
+				// lagging, or cut off from a majority, so ask
+				// the next one first.
+				if len(reply.Events) == 0 && reply.NextSeq <= args.FromSeq {
+					first = (i + 1) % len(ck.servers)
+				} else {
+					first = i
+				}
+				args.FromSeq = reply.NextSeq
+				answered = true
+				break
+			}
+			if compacted == len(ck.servers) {
+				return
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if !answered {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}()
+	return ch, cancel
+}
@@ -1,34 +1,163 @@
 package kvpaxos
 
+import "hash/fnv"
+
+const (
+	OK      = "OK"
+	PUT     = "PUT"
+	GET     = "GET"
+	NOOP    = "NOOP"
+	APPEND  = "APPEND"
+	PUTHASH = "PUTHASH"
+	CAS     = "CAS"
+	DELETE  = "DELETE"
+	TXN     = "TXN"
+	SCAN    = "SCAN"
+)
+
 const (
-	OK       = "OK"
-	ErrNoKey = "ErrNoKey"
-	PUT      = "PUT"
-	GET      = "GET"
+	ErrNoKey       Err = "ErrNoKey"
+	ErrCheckFailed Err = "ErrCheckFailed"
+	ErrCompacted   Err = "ErrCompacted"
+	ErrTimeout     Err = "ErrTimeout" // no server answered before the deadline
 )
 
 type Err string
 
+//
+// lets GetContext return ErrNoKey as an error. ErrCheckFailed
+// never reaches the caller: TxnContext reports it as false.
+//
+func (e Err) Error() string {
+	return string(e)
+}
+
 type PutArgs struct {
 	// You'll have to add definitions here.
 	Key       string
 	Value     string
-	RequestID int
+	RequestID int // increases with each request from ClientID
 	ClientID  int
+	Op        string // PUT, APPEND, PUTHASH, CAS or DELETE; "" means PUT
+	Expected  string // CAS only writes Value if the key holds this
 }
 
 type PutReply struct {
-	Err Err
+	Err           Err
+	PreviousValue string // the key's value before the write, or ""
+	Leader        int    // index of the server to try first next time, or -1
 }
 
 type GetArgs struct {
 	// You'll have to add definitions here.
 	Key       string
-	RequestID int
+	RequestID int // increases with each request from ClientID
 	ClientID  int
 }
 
 type GetReply struct {
-	Err   Err
+	Err    Err
+	Value  string
+	Leader int // index of the server to try first next time, or -1
+}
+
+// a transaction only writes if every key it checks
+// holds the expected value ("" for a missing key).
+type Check struct {
+	Key   string
 	Value string
 }
+
+type Write struct {
+	Key    string
+	Value  string
+	Delete bool // remove Key instead of setting it
+}
+
+type TxnArgs struct {
+	Checks    []Check
+	Writes    []Write
+	RequestID int
+	ClientID  int
+}
+
+type TxnReply struct {
+	Err    Err // OK if the writes happened, ErrCheckFailed if not
+	Leader int // index of the server to try first next time, or -1
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// most pairs returned in one page of a Scan.
+const maxScan = 1000
+
+type ScanArgs struct {
+	Start     string
+	End       string // "" for no upper bound
+	Limit     int    // <= 0 for as many as one page holds
+	Token     string // from the previous page's reply, or ""
+	RequestID int
+	ClientID  int
+}
+
+type ScanReply struct {
+	Err       Err
+	KeyValues []KeyValue
+	Token     string // pass back to get the next page; "" after the last
+	Seq       int    // the log position this page was read at
+	Leader    int    // index of the server to try first next time, or -1
+}
+
+// one applied write, as seen by Watch.
+type Event struct {
+	Seq     int // the paxos instance the write was decided in
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+type WatchArgs struct {
+	Key     string
+	Prefix  bool // watch every key starting with Key
+	FromSeq int  // only writes decided in this instance or later
+}
+
+type WatchReply struct {
+	Err     Err // OK, or ErrCompacted if writes from FromSeq are gone
+	Events  []Event
+	NextSeq int // FromSeq for the next call
+}
+
+// a client's most recent request, and the reply to it.
+type LastReply struct {
+	RequestID int
+	Reply     GetReply
+}
+
+// the key/value state as of the end of instance Seq.
+type Snapshot struct {
+	Seq     int
+	DB      map[string]string
+	Clients map[int]LastReply
+}
+
+type SnapshotArgs struct {
+	Seq int // the instance the caller is stuck on
+}
+
+type SnapshotReply struct {
+	OK       bool // Snapshot covers Seq
+	Snapshot Snapshot
+}
+
+//
+// PUTHASH stores hash(previous value + Value).
+//
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
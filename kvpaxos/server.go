@@ -11,6 +11,7 @@ import "syscall"
 import "encoding/gob"
 import "math/rand"
 import "time"
+import "strconv"
 
 
 type Op struct {
@@ -22,6 +23,9 @@ type Op struct {
   Value string
   From int
   RequestID int
+  Expected string
+  Checks []Check
+  Writes []Write
 }
 
 func MakeGetOp(optype string, key string, from int, requestID int) Op {
@@ -54,8 +58,20 @@ type KVPaxos struct {
 
   // Your definitions here.
   currentSeq int
-  requestsSeen map[int]GetReply //from requestID -> requests seen
-  db map[string]string //key/value storage
+  clients map[int]LastReply //from ClientID -> its latest request
+  db *Store //key/value storage
+  localReads bool //serve Gets from db instead of through the log
+  servers []string
+
+  changes []Event //recent writes, oldest first, for Watch
+  changesFrom int //changes holds every write from this instance on
+
+  waiters map[requestKey][]chan GetReply //handlers waiting for the applier
+  progress *sync.Cond //on mu, signalled when currentSeq advances
+  readIndex int //highest ReadIndex() a local read is waiting for
+
+  snapMu sync.Mutex //guards snapshot, so peers can fetch it while we wait on paxos
+  snapshot Snapshot //state as of snapshot.Seq, which we've told paxos we're Done with
 }
 
 // 
@@ -71,26 +87,31 @@ type KVPaxos struct {
 // the kvpaxos servers agree on this order.
 // 
 
+//
+// get op into the log. returns the instance it was decided
+// in, though by then the applier may already be past it.
+// many handlers can be here at once; none hold kv.mu.
+//
 func (kv *KVPaxos) Paxos(op Op) int {
+  kv.mu.Lock()
   seq := kv.currentSeq
-  for {
+  kv.mu.Unlock()
+
+  for kv.dead == false {
     kv.px.Start(seq, op)
-    sleepTime := 10 * time.Millisecond //20 * time.Millisecond
-    var actualOp Op
-    for {
-      done, top := kv.px.Status(seq)
-      //has paxos decided? 
-      if done {
-        actualOp = top.(Op)
-        break
-      }
-      time.Sleep(sleepTime)
-      //readjust sleepTime
-      if sleepTime < 10 * time.Second {
-        sleepTime *= 2
+    done, top := kv.px.WaitDecided(seq, time.Second)
+    if !done {
+      //the applier may have moved past seq, e.g. with a snapshot
+      kv.mu.Lock()
+      if seq < kv.currentSeq {
+        seq = kv.currentSeq
       }
+      kv.mu.Unlock()
+      continue
     }
-    if actualOp == op{
+    //a client's RequestID names one request, and ops
+    //holding a transaction can't be compared with ==
+    if actualOp := top.(Op); actualOp.From == op.From && actualOp.RequestID == op.RequestID{
       break;
     } else {
       seq++
@@ -100,107 +121,364 @@ func (kv *KVPaxos) Paxos(op Op) int {
   return seq
 }
 
+type requestKey struct {
+  client int
+  request int
+}
+
+//
+// put op in the log and wait for the applier to execute it.
+// returns the reply the applier recorded.
+//
+func (kv *KVPaxos) submit(op Op) GetReply {
+  kv.mu.Lock()
+  //check to see if we've already handled this 
+  if existingReply, found := kv.seen(op.From, op.RequestID); found{
+    kv.mu.Unlock()
+    return existingReply
+  }
+  key := requestKey{op.From, op.RequestID}
+  ch := make(chan GetReply, 1)
+  kv.waiters[key] = append(kv.waiters[key], ch)
+  kv.mu.Unlock()
+
+  kv.Paxos(op)
+
+  for {
+    select {
+    case reply := <-ch:
+      return reply
+    case <-time.After(applyWait):
+      if kv.dead {
+        return GetReply{}
+      }
+    }
+  }
+}
+
+//
+// hand a request's reply to any handler waiting for it.
+// call with kv.mu held.
+//
+func (kv *KVPaxos) wake(clientID int, requestID int) {
+  key := requestKey{clientID, requestID}
+  chs, found := kv.waiters[key]
+  if !found {
+    return
+  }
+  reply, _ := kv.seen(clientID, requestID)
+  for _, ch := range chs {
+    ch <- reply
+  }
+  delete(kv.waiters, key)
+}
+
+// after a snapshot, wake everyone it answers.
+func (kv *KVPaxos) wakeAll() {
+  for key := range kv.waiters {
+    if _, found := kv.seen(key.client, key.request); found {
+      kv.wake(key.client, key.request)
+    }
+  }
+}
+
+//
+// we've applied everything up to seq. Done() is only
+// called at snapshot points, so that the instances
+// paxos forgets are always covered by our snapshot.
+//
+func (kv *KVPaxos) applied(seq int) {
+  kv.currentSeq = seq + 1
+  kv.progress.Broadcast()
+
+  kv.snapMu.Lock()
+  due := seq - kv.snapshot.Seq >= snapshotInterval
+  kv.snapMu.Unlock()
+  if due {
+    kv.takeSnapshot()
+    kv.px.Done(seq)
+  }
+}
+
+//
+// the reply to a request we've already executed, if any.
+// a Clerk has one request outstanding at a time, so only
+// its latest reply needs keeping; anything older is a
+// retry whose answer the Clerk has stopped waiting for.
+//
+func (kv *KVPaxos) seen(clientID int, requestID int) (GetReply, bool) {
+  last, found := kv.clients[clientID]
+  if !found || requestID > last.RequestID {
+    return GetReply{}, false
+  }
+  return last.Reply, true
+}
+
+//
+// apply one op, decided in instance seq, to db. the
+// reply's Value is the key's value before the op.
+//
+func (kv *KVPaxos) execute(seq int, op Op) GetReply {
+  var reply GetReply
+  prev, found := kv.db.Get(op.Key)
+  reply.Err = OK
+  reply.Value = prev
+
+  switch op.Type {
+  case GET:
+    if !found {
+      reply.Err = ErrNoKey
+    }
+  case PUT:
+    kv.set(seq, op.Key, op.Value)
+  case APPEND:
+    kv.set(seq, op.Key, prev + op.Value)
+  case PUTHASH:
+    kv.set(seq, op.Key, strconv.Itoa(int(hash(prev + op.Value))))
+  case CAS:
+    if prev == op.Expected {
+      kv.set(seq, op.Key, op.Value)
+    }
+  case DELETE:
+    kv.remove(seq, op.Key)
+  case TXN:
+    for _, c := range op.Checks {
+      if v, _ := kv.db.Get(c.Key); v != c.Value {
+        reply.Err = ErrCheckFailed
+        return reply
+      }
+    }
+    for _, w := range op.Writes {
+      if w.Delete {
+        kv.remove(seq, w.Key)
+      } else {
+        kv.set(seq, w.Key, w.Value)
+      }
+    }
+  }
+  return reply
+}
+
 func (kv *KVPaxos) UpdateLocalLog(currentSeq int, seq int){
   for i := currentSeq; i <= seq; i++ {
     if done, value := kv.px.Status(i); done {
       iOp := value.(Op)
-      if iOp.Type == PUT {
-        if _, ok := kv.requestsSeen[iOp.RequestID]; !ok {
-          var reply GetReply
-          reply.Err = OK
-          kv.requestsSeen[iOp.RequestID] = reply
-          kv.db[iOp.Key] = iOp.Value
-        }
-      } else if iOp.Type == GET {
-        if _, ok := kv.requestsSeen[iOp.RequestID]; !ok {
-          var reply GetReply
-          if value, _ok := kv.db[iOp.Key]; _ok{
-            reply.Err = OK
-            reply.Value = value
-          } else {
-              reply.Err = ErrNoKey
-          }
-          kv.requestsSeen[iOp.RequestID] = reply
-        }
+      if iOp.Type == NOOP {
+        continue
       }
+      if _, dup := kv.seen(iOp.From, iOp.RequestID); !dup {
+        kv.clients[iOp.From] = LastReply{iOp.RequestID, kv.execute(i, iOp)}
+      }
+      kv.wake(iOp.From, iOp.RequestID)
     }
   }
 } 
 
 
-func (kv *KVPaxos) Get(args *GetArgs, reply *GetReply) error {
-  // Your code here.
-  //don't forget to lock :)
-  kv.mu.Lock()
-  defer kv.mu.Unlock()
+// how long the applier waits on an instance before
+// treating it as a hole.
+const applyWait = 500 * time.Millisecond
 
-  // optype, value, from, requestID
-  op := MakeGetOp(GET, args.Key, args.ClientID, args.RequestID)
+//
+// the only code that applies the log. it applies decided
+// instances to db as they arrive, whether or not this replica
+// is serving any requests, so that an idle replica keeps up
+// and keeps calling Done(). an instance that stays undecided
+// while a later one has been accepted, or while a local read
+// waits for it, is a hole, filled with a no-op. one that's
+// been forgotten is filled from a peer's snapshot. an idle
+// log has no holes, so it stays idle.
+//
+func (kv *KVPaxos) applier() {
+  for kv.dead == false {
+    kv.mu.Lock()
+    seq := kv.currentSeq
+    kv.mu.Unlock()
 
-  
-  //check to see if we've already handled this 
-  if existingReply, ok := kv.requestsSeen[op.RequestID]; ok{
-    reply.Value = existingReply.Value
-    reply.Err = existingReply.Err
-    return nil
-  }
+    done, _ := kv.px.WaitDecided(seq, applyWait)
 
-  //send the op to paxos
-  seq := kv.Paxos(op)
+    stuck := false
+    kv.mu.Lock()
+    if kv.currentSeq == seq {
+      if done {
+        kv.UpdateLocalLog(seq, seq)
+        kv.applied(seq)
+      } else if seq < kv.px.Min() {
+        stuck = !kv.installSnapshot(seq)
+      } else if seq < kv.px.MaxAccepted() || seq <= kv.readIndex {
+        //a fresh replica that has applied nothing may have
+        //joined after its peers forgot the start of the log
+        if seq > 0 || !kv.installSnapshot(seq) {
+          kv.px.Start(seq, Op{Type: NOOP})
+        }
+      }
+    }
+    kv.mu.Unlock()
+
+    if stuck {
+      //forgotten, and no peer could give us a snapshot yet
+      time.Sleep(applyWait)
+    }
+  }
 
-  //update the log from where I am to where Paxos currently is
-  cS, s := kv.currentSeq, seq
-  kv.UpdateLocalLog(cS, s) 
+  //let readers see we're dead
+  kv.mu.Lock()
+  kv.progress.Broadcast()
+  kv.mu.Unlock()
+}
 
-  //fill in reply
-  if existingReply, ok := kv.requestsSeen[op.RequestID]; ok{
-    reply.Value = existingReply.Value
-    reply.Err = existingReply.Err
+//
+// wait for the applier to bring db up to date without adding
+// to the log. every write that has completed is at or below
+// the paxos ReadIndex(), so once the log is applied that far
+// the local db can serve reads. instances up to there were
+// accepted by some peer, so the applier may fill any we
+// missed. returns false if a majority of paxos peers couldn't
+// be reached, and the read should go through the log instead.
+// returns with kv.mu held if true.
+//
+func (kv *KVPaxos) catchUp() bool {
+  seq, ok := kv.px.ReadIndex()
+  if !ok {
+    return false
   }
 
-  //call done
-  kv.px.Done(s)
+  kv.mu.Lock()
+  if seq > kv.readIndex {
+    kv.readIndex = seq
+  }
+  for kv.currentSeq <= seq && kv.dead == false {
+    kv.progress.Wait()
+  }
+  return true
+}
 
-  //update currentSeq
-  kv.currentSeq = s + 1
-  return nil
+//
+// the index in servers[] of the paxos leader, which can
+// put requests in the log without running phase 1.
+//
+func (kv *KVPaxos) leaderHint() int {
+  leader := kv.px.Leader()
+  for i, srv := range kv.servers {
+    if srv == leader {
+      return i
+    }
+  }
+  return -1
 }
 
+func (kv *KVPaxos) reading() bool {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  return kv.localReads
+}
 
-func (kv *KVPaxos) Put(args *PutArgs, reply *PutReply) error {
-  // Your code here.
-  //don't forget to lock :)
+//
+// turn local reads on (the default) or off. when off, every
+// Get is agreed on in its own paxos instance, as Puts are.
+//
+func (kv *KVPaxos) SetLocalReads(on bool) {
   kv.mu.Lock()
   defer kv.mu.Unlock()
+  kv.localReads = on
+}
 
+func (kv *KVPaxos) Get(args *GetArgs, reply *GetReply) error {
+  // Your code here.
+  defer func() { reply.Leader = kv.leaderHint() }()
 
-  //optype, key, value, from, requestID
-  op := MakePutOp(PUT, args.Key, args.Value, args.ClientID, args.RequestID)
-  
-  //check to see if we've already handled this 
-  if existingReply, found := kv.requestsSeen[op.RequestID]; found{
-    reply.Err = existingReply.Err
+  if kv.reading() && kv.catchUp() {
+    defer kv.mu.Unlock()
+    if value, found := kv.db.Get(args.Key); found {
+      reply.Err = OK
+      reply.Value = value
+    } else {
+      reply.Err = ErrNoKey
+    }
     return nil
   }
 
-  //send the op to paxos
-  seq := kv.Paxos(op)
+  // optype, value, from, requestID
+  op := MakeGetOp(GET, args.Key, args.ClientID, args.RequestID)
 
-  //update the log from where I am to where Paxos currently is
-  cS, s := kv.currentSeq, seq
-  //go is pass by what?
-  kv.UpdateLocalLog(cS, s) 
+  existingReply := kv.submit(op)
+  reply.Value = existingReply.Value
+  reply.Err = existingReply.Err
+  return nil
+}
+
+
+func (kv *KVPaxos) Put(args *PutArgs, reply *PutReply) error {
+  // Your code here.
+  optype := args.Op
+  if optype == "" {
+    optype = PUT
+  }
+  //optype, key, value, from, requestID
+  op := MakePutOp(optype, args.Key, args.Value, args.ClientID, args.RequestID)
+  op.Expected = args.Expected
+
+  existingReply := kv.submit(op)
+  reply.Err = existingReply.Err
+  reply.PreviousValue = existingReply.Value
+  reply.Leader = kv.leaderHint()
+  return nil
+}
+
+//
+// apply a list of writes atomically, if every check passes.
+//
+func (kv *KVPaxos) Txn(args *TxnArgs, reply *TxnReply) error {
+  op := Op{}
+  op.Type = TXN
+  op.From = args.ClientID
+  op.RequestID = args.RequestID
+  op.Checks = args.Checks
+  op.Writes = args.Writes
+
+  existingReply := kv.submit(op)
+  reply.Err = existingReply.Err
+  reply.Leader = kv.leaderHint()
+  return nil
+}
 
-  //update reply 
-  if existingReply, found := kv.requestsSeen[op.RequestID]; found{
-    reply.Err = existingReply.Err
+//
+// list keys in [Start, End) in order, a page at a time. each
+// page is read from db as of a single log position, returned
+// in reply.Seq; later pages may come from later positions.
+//
+func (kv *KVPaxos) Scan(args *ScanArgs, reply *ScanReply) error {
+  if !kv.reading() || !kv.catchUp() {
+    //a SCAN op only marks a position in the log
+    op := Op{}
+    op.Type = SCAN
+    op.From = args.ClientID
+    op.RequestID = args.RequestID
+    kv.submit(op)
+    kv.mu.Lock()
   }
+  defer kv.mu.Unlock()
 
-  //call done
-  kv.px.Done(s)
+  start := args.Start
+  if args.Token != "" {
+    start = args.Token
+  }
+  limit := args.Limit
+  if limit <= 0 || limit > maxScan {
+    limit = maxScan
+  }
 
-  //update currentSeq
-  kv.currentSeq = s + 1
+  //one extra pair tells us whether there's another page
+  kvs := kv.db.Scan(start, args.End, limit + 1)
+  reply.Token = ""
+  if len(kvs) > limit {
+    reply.Token = kvs[limit].Key
+    kvs = kvs[:limit]
+  }
+  reply.Err = OK
+  reply.KeyValues = kvs
+  reply.Seq = kv.currentSeq - 1
+  reply.Leader = kv.leaderHint()
   return nil
 }
 
@@ -217,8 +495,25 @@ func (kv *KVPaxos) kill() {
 // servers that will cooperate via Paxos to
 // form the fault-tolerant key/value service.
 // me is the index of the current server in servers[].
+// its Paxos state lives only in memory, so a server
+// started this way must not be restarted as servers[me].
 // 
 func StartServer(servers []string, me int) *KVPaxos {
+  return startServer(servers, me, "")
+}
+
+//
+// like StartServer, but the Paxos acceptor state is kept
+// in dir, so the server may crash and be restarted with
+// the same dir. it comes back with what it promised and
+// accepted, and catches up on anything its peers have
+// since forgotten from a snapshot.
+//
+func StartServerWithStorage(servers []string, me int, dir string) *KVPaxos {
+  return startServer(servers, me, dir)
+}
+
+func startServer(servers []string, me int, dir string) *KVPaxos {
   // this call is all that's needed to persuade
   // Go's RPC library to marshall/unmarshall
   // struct Op.
@@ -228,14 +523,28 @@ func StartServer(servers []string, me int) *KVPaxos {
   kv.me = me
 
   // Your initialization code here.
-  kv.db = map[string]string{}
-  kv.requestsSeen = map[int]GetReply{}
+  kv.db = MakeStore()
+  kv.clients = map[int]LastReply{}
+  kv.localReads = true
+  kv.servers = servers
+  kv.waiters = map[requestKey][]chan GetReply{}
+  kv.readIndex = -1
+  kv.progress = sync.NewCond(&kv.mu)
+  kv.snapshot = Snapshot{-1, map[string]string{}, map[int]LastReply{}}
 
 
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
 
-  kv.px = paxos.Make(servers, me, rpcs)
+  if dir == "" {
+    kv.px = paxos.Make(servers, me, rpcs)
+  } else {
+    kv.px = paxos.MakeWithStorage(servers, me, rpcs, dir)
+  }
+  // skip phase 1 for Puts and Gets while one replica keeps winning.
+  kv.px.SetLeaderMode(true)
+
+  go kv.applier()
 
   os.Remove(servers[me])
   l, e := net.Listen("unix", servers[me]);
@@ -0,0 +1,84 @@
+package kvpaxos
+
+//
+// snapshots of the key/value state, so that paxos can
+// forget old instances and a replica that missed them
+// (e.g. one restarted with an empty db) can still catch up.
+//
+// every snapshotInterval instances a replica copies db and
+// clients, tagged with the last instance applied, and
+// only then tells paxos it is Done() with that instance. a
+// replica that finds an instance it needs has been forgotten
+// asks its peers for a snapshot covering it instead.
+//
+
+// how many instances to apply between snapshots.
+const snapshotInterval = 50
+
+func copySnapshot(seq int, db *Store, clients map[int]LastReply) Snapshot {
+  snap := Snapshot{seq, db.Map(), map[int]LastReply{}}
+  for id, last := range clients {
+    snap.Clients[id] = last
+  }
+  return snap
+}
+
+// call with kv.mu held.
+func (kv *KVPaxos) takeSnapshot() {
+  snap := copySnapshot(kv.currentSeq - 1, kv.db, kv.clients)
+  kv.snapMu.Lock()
+  kv.snapshot = snap
+  kv.snapMu.Unlock()
+}
+
+//
+// hand our latest snapshot to a peer that needs instance
+// args.Seq. doesn't take kv.mu, which may be held for as
+// long as an agreement takes.
+//
+func (kv *KVPaxos) FetchSnapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+  kv.snapMu.Lock()
+  defer kv.snapMu.Unlock()
+
+  reply.OK = false
+  if kv.snapshot.Seq >= args.Seq {
+    reply.OK = true
+    reply.Snapshot = kv.snapshot
+  }
+  return nil
+}
+
+//
+// replace our state with a peer's snapshot that covers
+// instance seq. returns false if no peer has one.
+// call with kv.mu held.
+//
+func (kv *KVPaxos) installSnapshot(seq int) bool {
+  for i, srv := range kv.servers {
+    if i == kv.me {
+      continue
+    }
+    args := &SnapshotArgs{seq}
+    var reply SnapshotReply
+    if !call(srv, "KVPaxos.FetchSnapshot", args, &reply) || !reply.OK {
+      continue
+    }
+    //gob leaves empty maps out
+    snap := reply.Snapshot
+    kv.db = StoreFromMap(snap.DB)
+    kv.clients = map[int]LastReply{}
+    for id, last := range snap.Clients {
+      kv.clients[id] = last
+    }
+    kv.currentSeq = snap.Seq + 1
+    //we never saw the writes the snapshot covers
+    kv.changes = nil
+    kv.changesFrom = kv.currentSeq
+    kv.takeSnapshot()
+    kv.px.Done(snap.Seq)
+    kv.progress.Broadcast()
+    kv.wakeAll()
+    return true
+  }
+  return false
+}
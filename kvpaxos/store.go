@@ -0,0 +1,84 @@
+package kvpaxos
+
+//
+// the key/value database: a map for point lookups plus
+// the keys in sorted order, so ranges can be scanned.
+// adding or removing a key costs O(number of keys);
+// overwriting an existing key is O(1).
+//
+
+import "sort"
+
+type Store struct {
+  values map[string]string
+  keys []string // sorted
+}
+
+func MakeStore() *Store {
+  st := &Store{}
+  st.values = map[string]string{}
+  st.keys = []string{}
+  return st
+}
+
+func (st *Store) Get(key string) (string, bool) {
+  value, found := st.values[key]
+  return value, found
+}
+
+func (st *Store) Put(key string, value string) {
+  if _, found := st.values[key]; !found {
+    i := sort.SearchStrings(st.keys, key)
+    st.keys = append(st.keys, "")
+    copy(st.keys[i+1:], st.keys[i:])
+    st.keys[i] = key
+  }
+  st.values[key] = value
+}
+
+func (st *Store) Delete(key string) {
+  if _, found := st.values[key]; !found {
+    return
+  }
+  i := sort.SearchStrings(st.keys, key)
+  st.keys = append(st.keys[:i], st.keys[i+1:]...)
+  delete(st.values, key)
+}
+
+//
+// up to limit pairs with start <= key < end, in key order.
+// end == "" means no upper bound; limit <= 0 means no limit.
+//
+func (st *Store) Scan(start string, end string, limit int) []KeyValue {
+  kvs := []KeyValue{}
+  for i := sort.SearchStrings(st.keys, start); i < len(st.keys); i++ {
+    key := st.keys[i]
+    if end != "" && key >= end {
+      break
+    }
+    if limit > 0 && len(kvs) >= limit {
+      break
+    }
+    kvs = append(kvs, KeyValue{key, st.values[key]})
+  }
+  return kvs
+}
+
+// a plain map of the contents, for snapshots.
+func (st *Store) Map() map[string]string {
+  m := map[string]string{}
+  for k, v := range st.values {
+    m[k] = v
+  }
+  return m
+}
+
+func StoreFromMap(m map[string]string) *Store {
+  st := MakeStore()
+  for k, v := range m {
+    st.values[k] = v
+    st.keys = append(st.keys, k)
+  }
+  sort.Strings(st.keys)
+  return st
+}
@@ -7,6 +7,9 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "strings"
+import "context"
+import "sync"
 
 func check(t *testing.T, ck *Clerk, key string, value string) {
   v := ck.Get(key)
@@ -176,6 +179,192 @@ func TestDone(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+func TestLocalReads(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("local", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  fmt.Printf("Test: Gets don't use the log ...\n")
+
+  for i := 0; i < nservers; i++ {
+    cka[i].Put("a", strconv.Itoa(i))
+    for j := 0; j < nservers; j++ {
+      check(t, cka[j], "a", strconv.Itoa(i))
+    }
+  }
+
+  max := kva[0].px.MaxAccepted()
+  for iters := 0; iters < 10; iters++ {
+    for i := 0; i < nservers; i++ {
+      check(t, cka[i], "a", strconv.Itoa(nservers - 1))
+    }
+  }
+  if kva[0].px.MaxAccepted() != max {
+    t.Fatalf("Gets added instances %v..%v to the log", max + 1, kva[0].px.MaxAccepted())
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Log-ordered Gets when local reads are off ...\n")
+
+  for i := 0; i < nservers; i++ {
+    kva[i].SetLocalReads(false)
+  }
+  check(t, cka[1], "a", strconv.Itoa(nservers - 1))
+  if kva[1].px.MaxAccepted() <= max {
+    t.Fatalf("Get did not go through the log")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  var dirs []string = make([]string, nservers)
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("snap", i)
+    dirs[i] = port("snapdir", i)
+    os.RemoveAll(dirs[i])
+    defer os.RemoveAll(dirs[i])
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServerWithStorage(kvh, i, dirs[i])
+  }
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  fmt.Printf("Test: Paxos forgets instances covered by snapshots ...\n")
+
+  const nkeys = 10
+  for iters := 0; iters < 3 * snapshotInterval; iters++ {
+    cka[iters % nservers].Put(strconv.Itoa(iters % nkeys), strconv.Itoa(iters))
+  }
+  for i := 0; i < nservers; i++ {
+    check(t, cka[i], "0", strconv.Itoa(3 * snapshotInterval - nkeys))
+  }
+  for i := 0; i < nservers; i++ {
+    if kva[i].px.Min() == 0 {
+      t.Fatalf("server %v's paxos forgot nothing", i)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted server installs a snapshot ...\n")
+
+  kva[2].kill()
+  kva[2] = StartServerWithStorage(kvh, 2, dirs[2])
+
+  cka[0].Put("new", "x")
+  check(t, cka[2], "new", "x")
+  for k := 0; k < nkeys; k++ {
+    check(t, cka[2], strconv.Itoa(k), strconv.Itoa(3 * snapshotInterval - nkeys + k))
+  }
+  cka[2].Put("new", "y")
+  check(t, cka[1], "new", "y")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDuplicates(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("dup", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Retried Put after failover is filtered ...\n")
+
+  args := &PutArgs{"a", "1", 1, 12345, PUT, ""}
+  var reply PutReply
+  if !call(kvh[0], "KVPaxos.Put", args, &reply) || reply.Err != OK {
+    t.Fatalf("Put failed")
+  }
+  ck.Put("a", "2")
+
+  // the first reply was lost; the client retries elsewhere.
+  if !call(kvh[1], "KVPaxos.Put", args, &reply) || reply.Err != OK {
+    t.Fatalf("retried Put failed")
+  }
+  check(t, ck, "a", "2")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Duplicate table grows with clients, not requests ...\n")
+
+  const nclients = 5
+  for i := 0; i < nclients; i++ {
+    myck := MakeClerk(kvh)
+    for j := 0; j < 20; j++ {
+      myck.Put("b", strconv.Itoa(j))
+    }
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i].mu.Lock()
+    n := len(kva[i].clients)
+    kva[i].mu.Unlock()
+    if n > nclients + 2 {
+      t.Fatalf("server %v remembers %v clients", i, n)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: One Clerk shared by many goroutines ...\n")
+
+  // each request must reach the servers after the one
+  // before it, or it's taken for a duplicate.
+  const nthreads = 5
+  const nappends = 5
+  var wg sync.WaitGroup
+  for i := 0; i < nthreads; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for j := 0; j < nappends; j++ {
+        ck.Append("shared", "x")
+      }
+    }()
+  }
+  wg.Wait()
+  if v := ck.Get("shared"); len(v) != nthreads * nappends {
+    t.Fatalf("shared Clerk appended %v times, expected %v", len(v), nthreads * nappends)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func pp(tag string, src int, dst int) string {
   s := "/var/tmp/824-"
   s += strconv.Itoa(os.Getuid()) + "/"
@@ -433,6 +622,739 @@ func TestUnreliable(t *testing.T) {
   time.Sleep(1 * time.Second)
 }
 
+func TestAtomicOps(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "atomic"
+  const nservers = 5
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartServer(kvh, i)
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+  part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+
+  var cka [nservers]*Clerk
+  var all []string
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{port(tag, i)})
+    all = append(all, port(tag, i))
+  }
+
+  fmt.Printf("Test: Append, PutHash, CAS and Delete ...\n")
+
+  cka[0].Append("a", "x")
+  cka[1].Append("a", "y")
+  check(t, cka[2], "a", "xy")
+
+  if prev := cka[2].PutHash("h", "1"); prev != "" {
+    t.Fatalf("PutHash() of a new key returned %v", prev)
+  }
+  if prev := cka[3].PutHash("h", "2"); prev != strconv.Itoa(int(hash("1"))) {
+    t.Fatalf("PutHash() returned %v", prev)
+  }
+
+  if prev := cka[0].CAS("a", "xy", "z"); prev != "xy" {
+    t.Fatalf("CAS() returned %v, expected xy", prev)
+  }
+  if prev := cka[1].CAS("a", "xy", "w"); prev != "z" {
+    t.Fatalf("failed CAS() returned %v, expected z", prev)
+  }
+  check(t, cka[4], "a", "z")
+
+  cka[4].Delete("a")
+  check(t, cka[0], "a", "")
+  if prev := cka[0].CAS("a", "", "new"); prev != "" {
+    t.Fatalf("CAS() of a deleted key returned %v", prev)
+  }
+  check(t, cka[3], "a", "new")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent appends and CAS, unreliable ...\n")
+
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = true
+  }
+  cka[0].Put("n", "0")
+
+  const nclients = 5
+  const nops = 5
+  var ca [nclients]chan bool
+  for cli := 0; cli < nclients; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      myck := MakeClerk(all)
+      for i := 0; i < nops; i++ {
+        myck.Append("log", fmt.Sprintf("(%v,%v)", me, i))
+        // increment n with a CAS loop
+        for {
+          v := myck.Get("n")
+          n, _ := strconv.Atoi(v)
+          if myck.CAS("n", v, strconv.Itoa(n + 1)) == v {
+            break
+          }
+        }
+      }
+    }(cli)
+  }
+  for cli := 0; cli < nclients; cli++ {
+    <- ca[cli]
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = false
+  }
+
+  log := cka[0].Get("log")
+  for cli := 0; cli < nclients; cli++ {
+    for i := 0; i < nops; i++ {
+      if n := strings.Count(log, fmt.Sprintf("(%v,%v)", cli, i)); n != 1 {
+        t.Fatalf("append (%v,%v) appears %v times in %v", cli, i, n, log)
+      }
+    }
+  }
+  check(t, cka[1], "n", strconv.Itoa(nclients * nops))
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Appends under partition ...\n")
+
+  part(t, tag, nservers, []int{0,1,2}, []int{3,4}, []int{})
+  cka[0].Put("p", "a")
+  done := false
+  go func() {
+    cka[3].Append("p", "c")
+    done = true
+  }()
+  cka[1].Append("p", "b")
+  check(t, cka[2], "p", "ab")
+  time.Sleep(time.Second)
+  if done {
+    t.Fatalf("Append in minority completed")
+  }
+
+  part(t, tag, nservers, []int{0,1,2,3,4}, []int{}, []int{})
+  for iters := 0; iters < 30 && !done; iters++ {
+    time.Sleep(100 * time.Millisecond)
+  }
+  if !done {
+    t.Fatalf("Append did not complete after heal")
+  }
+  check(t, cka[4], "p", "abc")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTxn(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("txn", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Transactions check before writing ...\n")
+
+  ck.Put("a", "1")
+  if ck.Txn([]Check{{"a", "2"}}, []Write{{"a", "3", false}, {"b", "3", false}}) {
+    t.Fatalf("Txn() with a failing check committed")
+  }
+  check(t, ck, "a", "1")
+  check(t, ck, "b", "")
+
+  if !ck.Txn([]Check{{"a", "1"}, {"b", ""}}, []Write{{"a", "", true}, {"b", "4", false}}) {
+    t.Fatalf("Txn() with passing checks did not commit")
+  }
+  check(t, ck, "a", "")
+  check(t, ck, "b", "4")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Concurrent transfers, unreliable ...\n")
+
+  for i := 0; i < nservers; i++ {
+    kva[i].unreliable = true
+  }
+  ck.Put("x", "100")
+  ck.Put("y", "100")
+
+  const nclients = 5
+  var ca [nclients]chan bool
+  for cli := 0; cli < nclients; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      myck := MakeClerk(kvh)
+      for i := 0; i < 5; i++ {
+        from, to := "x", "y"
+        if rand.Int() % 2 == 0 {
+          from, to = to, from
+        }
+        for {
+          fv := myck.Get(from)
+          tv := myck.Get(to)
+          f, _ := strconv.Atoi(fv)
+          n, _ := strconv.Atoi(tv)
+          amount := rand.Int() % 10
+          checks := []Check{{from, fv}, {to, tv}}
+          writes := []Write{{from, strconv.Itoa(f - amount), false}, {to, strconv.Itoa(n + amount), false}}
+          if myck.Txn(checks, writes) {
+            break
+          }
+        }
+      }
+    }(cli)
+  }
+  for cli := 0; cli < nclients; cli++ {
+    <- ca[cli]
+  }
+
+  x, _ := strconv.Atoi(ck.Get("x"))
+  y, _ := strconv.Atoi(ck.Get("y"))
+  if x + y != 200 {
+    t.Fatalf("x=%v y=%v; transfers were not atomic", x, y)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestScan(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("scan", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  fmt.Printf("Test: Scan pages through keys in order ...\n")
+
+  const nkeys = 45
+  for i := nkeys - 1; i >= 0; i-- {
+    cka[i % nservers].Put(fmt.Sprintf("k%02d", i), strconv.Itoa(i))
+  }
+  cka[0].Put("j", "before")
+  cka[1].Put("l", "after")
+
+  for i := 0; i < nservers; i++ {
+    token := ""
+    n := 0
+    for {
+      kvs, next := cka[i].Scan("k", "l", 10, token)
+      if len(kvs) > 10 {
+        t.Fatalf("page of %v pairs, limit 10", len(kvs))
+      }
+      for _, kv := range kvs {
+        if kv.Key != fmt.Sprintf("k%02d", n) || kv.Value != strconv.Itoa(n) {
+          t.Fatalf("Scan() returned %v, expected k%02d", kv, n)
+        }
+        n++
+      }
+      if next == "" {
+        break
+      }
+      token = next
+    }
+    if n != nkeys {
+      t.Fatalf("Scan() returned %v keys, expected %v", n, nkeys)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: ListPrefix ...\n")
+
+  cka[2].Delete("k13")
+  kvs := cka[0].ListPrefix("k1")
+  if len(kvs) != 9 || kvs[0].Key != "k10" || kvs[3].Key != "k14" {
+    t.Fatalf("ListPrefix(k1) returned %v", kvs)
+  }
+  if kvs := cka[1].ListPrefix(""); len(kvs) != nkeys + 1 {
+    t.Fatalf("ListPrefix() returned %v pairs, expected %v", len(kvs), nkeys + 1)
+  }
+
+  for i := 0; i < nservers; i++ {
+    kva[i].SetLocalReads(false)
+  }
+  cka[1].Put("k13", "back")
+  if kvs := cka[2].ListPrefix("k13"); len(kvs) != 1 || kvs[0].Value != "back" {
+    t.Fatalf("log-ordered ListPrefix(k13) returned %v", kvs)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func nextEvent(t *testing.T, ch <-chan Event) Event {
+  select {
+  case e, ok := <-ch:
+    if !ok {
+      t.Fatalf("Watch channel closed")
+    }
+    return e
+  case <-time.After(5 * time.Second):
+    t.Fatalf("no event from Watch")
+  }
+  return Event{}
+}
+
+func TestWatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  var dirs []string = make([]string, nservers)
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("watch", i)
+    dirs[i] = port("watchdir", i)
+    os.RemoveAll(dirs[i])
+    defer os.RemoveAll(dirs[i])
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServerWithStorage(kvh, i, dirs[i])
+  }
+  var cka [nservers]*Clerk
+  for i := 0; i < nservers; i++ {
+    cka[i] = MakeClerk([]string{kvh[i]})
+  }
+
+  fmt.Printf("Test: Watch a key and a prefix ...\n")
+
+  all, cancelAll := cka[0].Watch("w/", true, 0)
+  one, cancelOne := cka[1].Watch("w/a", false, 0)
+  defer cancelOne()
+
+  cka[2].Put("w/a", "1")
+  cka[0].Put("x", "ignored")
+  cka[1].Append("w/b", "2")
+  cka[2].Delete("w/a")
+  cka[0].Txn(nil, []Write{{"w/c", "3", false}, {"y", "ignored", false}})
+
+  expected := []Event{{0, "w/a", "1", false}, {0, "w/b", "2", false},
+    {0, "w/a", "", true}, {0, "w/c", "3", false}}
+  last := -1
+  for _, ex := range expected {
+    e := nextEvent(t, all)
+    if e.Key != ex.Key || e.Value != ex.Value || e.Deleted != ex.Deleted || e.Seq <= last {
+      t.Fatalf("prefix Watch got %v after seq %v, expected %v", e, last, ex)
+    }
+    last = e.Seq
+  }
+  first := nextEvent(t, one)
+  second := nextEvent(t, one)
+  if first.Value != "1" || !second.Deleted {
+    t.Fatalf("key Watch got %v, %v", first, second)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Resume a Watch from the last seen seq ...\n")
+
+  cancelAll()
+  cka[1].Put("w/d", "4")
+  cka[2].Put("w/e", "5")
+
+  resumed, cancelResumed := cka[2].Watch("w/", true, last + 1)
+  defer cancelResumed()
+  if e := nextEvent(t, resumed); e.Key != "w/d" {
+    t.Fatalf("resumed Watch got %v, expected w/d", e)
+  }
+  if e := nextEvent(t, resumed); e.Key != "w/e" {
+    t.Fatalf("resumed Watch got %v, expected w/e", e)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watch from before a snapshot install ...\n")
+
+  for i := 0; i < 2 * snapshotInterval; i++ {
+    cka[i % nservers].Put("z", strconv.Itoa(i))
+  }
+  for i := 0; i < nservers; i++ {
+    check(t, cka[i], "z", strconv.Itoa(2 * snapshotInterval - 1))
+  }
+  if kva[0].px.Min() == 0 {
+    t.Fatalf("paxos forgot nothing")
+  }
+  kva[2].kill()
+  kva[2] = StartServerWithStorage(kvh, 2, dirs[2])
+  check(t, cka[2], "z", strconv.Itoa(2 * snapshotInterval - 1))
+
+  gone, cancelGone := cka[2].Watch("w/", true, 0)
+  defer cancelGone()
+  select {
+  case e, ok := <-gone:
+    if ok {
+      t.Fatalf("Watch() got %v from a server that never saw it", e)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("Watch() from a compacted seq did not close")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWatchPartition(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "watchpart"
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartServer(kvh, i)
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+
+  fmt.Printf("Test: Watch moves past a server cut off from the majority ...\n")
+
+  part(t, tag, nservers, []int{1,2}, []int{0}, []int{})
+
+  // server 0 answers every Watch, but never with news.
+  ck := MakeClerk([]string{port(tag, 0), port(tag, 1), port(tag, 2)})
+  ch, cancel := ck.Watch("w", false, 0)
+  defer cancel()
+
+  ck1 := MakeClerk([]string{port(tag, 1)})
+  ck1.Put("w", "1")
+  if e := nextEvent(t, ch); e.Value != "1" {
+    t.Fatalf("Watch got %v, expected w=1", e)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestBackgroundApply(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("applier", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  ck := MakeClerk([]string{kvh[0]})
+
+  fmt.Printf("Test: Idle replicas apply the log ...\n")
+
+  for i := 0; i < 3 * snapshotInterval; i++ {
+    ck.Put("a", strconv.Itoa(i))
+  }
+
+  want := strconv.Itoa(3 * snapshotInterval - 1)
+  for i := 1; i < nservers; i++ {
+    ok := false
+    for iters := 0; iters < 50 && !ok; iters++ {
+      kva[i].mu.Lock()
+      v, _ := kva[i].db.Get("a")
+      kva[i].mu.Unlock()
+      ok = v == want
+      time.Sleep(100 * time.Millisecond)
+    }
+    if !ok {
+      t.Fatalf("idle server %v did not apply the log", i)
+    }
+  }
+
+  // Done() values ride on the next agreement.
+  ck.Put("b", "x")
+  if kva[0].px.Min() == 0 {
+    t.Fatalf("paxos forgot nothing while replicas were idle")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: An idle log stays idle ...\n")
+
+  time.Sleep(time.Second)
+  max := [nservers]int{}
+  for i := 0; i < nservers; i++ {
+    max[i] = kva[i].px.Max()
+  }
+  time.Sleep(4 * applyWait)
+  for i := 0; i < nservers; i++ {
+    if m := kva[i].px.Max(); m != max[i] {
+      t.Fatalf("idle server %v went from instance %v to %v", i, max[i], m)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestOutstanding(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("outstanding", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  fmt.Printf("Test: Many outstanding requests on one server ...\n")
+
+  const nclients = 10
+  var ca [nclients]chan bool
+  for cli := 0; cli < nclients; cli++ {
+    ca[cli] = make(chan bool)
+    go func(me int) {
+      defer func() { ca[me] <- true }()
+      myck := MakeClerk([]string{kvh[0]})
+      for i := 0; i < 10; i++ {
+        myck.Put(strconv.Itoa(me), strconv.Itoa(i))
+      }
+    }(cli)
+  }
+  for cli := 0; cli < nclients; cli++ {
+    <- ca[cli]
+  }
+  ck := MakeClerk([]string{kvh[1]})
+  for cli := 0; cli < nclients; cli++ {
+    check(t, ck, strconv.Itoa(cli), "9")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A stuck request doesn't block others ...\n")
+
+  args := &PutArgs{"a", "1", 1, 54321, PUT, ""}
+  var reply PutReply
+  if !call(kvh[0], "KVPaxos.Put", args, &reply) || reply.Err != OK {
+    t.Fatalf("Put failed")
+  }
+
+  // without a majority, this Put can't complete.
+  kva[1].kill()
+  kva[2].kill()
+  go MakeClerk([]string{kvh[0]}).Put("a", "2")
+  time.Sleep(100 * time.Millisecond)
+
+  retried := make(chan bool)
+  go func() {
+    var reply PutReply
+    call(kvh[0], "KVPaxos.Put", args, &reply)
+    retried <- reply.Err == OK
+  }()
+  select {
+  case ok := <-retried:
+    if !ok {
+      t.Fatalf("retried Put failed")
+    }
+  case <-time.After(3 * time.Second):
+    t.Fatalf("retried Put waited for a stuck one")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaderHint(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "hint"
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  defer cleanup(kva)
+  defer cleanpp(tag, nservers)
+
+  for i := 0; i < nservers; i++ {
+    var kvh []string = make([]string, nservers)
+    for j := 0; j < nservers; j++ {
+      if j == i {
+        kvh[j] = port(tag, i)
+      } else {
+        kvh[j] = pp(tag, i, j)
+      }
+    }
+    kva[i] = StartServer(kvh, i)
+  }
+  defer part(t, tag, nservers, []int{}, []int{}, []int{})
+
+  var kvh []string = make([]string, nservers)
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port(tag, i)
+  }
+
+  fmt.Printf("Test: Replies name the leader ...\n")
+
+  part(t, tag, nservers, []int{0,1,2}, []int{}, []int{})
+  MakeClerk([]string{kvh[2]}).Put("a", "1")
+  leader := kva[2].leaderHint()
+  if leader < 0 {
+    t.Fatalf("no leader hint after a Put")
+  }
+  ck := MakeClerk(kvh)
+  ck.leader = (leader + 1) % nservers
+  check(t, ck, "a", "1")
+  if ck.leader != leader {
+    t.Fatalf("Clerk prefers %v, leader is %v", ck.leader, leader)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A hung server costs one timeout ...\n")
+
+  // server 0 can't reach a majority, so its requests hang.
+  part(t, tag, nservers, []int{0}, []int{1,2}, []int{})
+  timeout := 300 * time.Millisecond
+  ck = MakeClerk(kvh)
+  ck.SetTimeout(timeout)
+
+  t0 := time.Now()
+  ck.Put("a", "2")
+  if d := time.Since(t0); d < timeout {
+    t.Fatalf("Put finished in %v without waiting for server 0", d)
+  }
+  if ck.leader == 0 {
+    t.Fatalf("Clerk still prefers the hung server")
+  }
+
+  t0 = time.Now()
+  for i := 0; i < 10; i++ {
+    ck.Put("a", strconv.Itoa(i))
+  }
+  if d := time.Since(t0); d > 5 * timeout {
+    t.Fatalf("10 Puts took %v; hung server not skipped", d)
+  }
+  check(t, ck, "a", "9")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestContext(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("context", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Context methods return errors ...\n")
+
+  ctx := context.Background()
+  if _, err := ck.GetContext(ctx, "a"); err != ErrNoKey {
+    t.Fatalf("GetContext of a missing key: %v, want ErrNoKey", err)
+  }
+  if err := ck.PutContext(ctx, "a", "x"); err != nil {
+    t.Fatalf("PutContext: %v", err)
+  }
+  if v, err := ck.GetContext(ctx, "a"); err != nil || v != "x" {
+    t.Fatalf("GetContext: %v %v, want x", v, err)
+  }
+  if ok, err := ck.TxnContext(ctx, []Check{{"a", "y"}}, []Write{{"a", "z", false}}); ok || err != nil {
+    t.Fatalf("TxnContext with a failed check: %v %v", ok, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A hung replica costs one per-call timeout ...\n")
+
+  // server 0, which the Clerk tries first, takes the
+  // request but never answers.
+  ck2 := MakeClerk(kvh)
+  ck2.SetTimeout(200 * time.Millisecond)
+  kva[0].mu.Lock()
+  hctx, hcancel := context.WithTimeout(ctx, 10 * time.Second)
+  t0 := time.Now()
+  err := ck2.PutContext(hctx, "b", "x")
+  d := time.Since(t0)
+  hcancel()
+  kva[0].mu.Unlock()
+  if err != nil {
+    t.Fatalf("PutContext past a hung replica: %v", err)
+  }
+  if d > 1500 * time.Millisecond {
+    t.Fatalf("PutContext waited %v on a hung replica", d)
+  }
+  check(t, ck, "b", "x")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Context deadlines bound an unavailable service ...\n")
+
+  // without a majority, no write can complete.
+  kva[1].kill()
+  kva[2].kill()
+
+  dctx, cancel := context.WithTimeout(ctx, 500 * time.Millisecond)
+  defer cancel()
+  t0 = time.Now()
+  if err := ck.PutContext(dctx, "a", "y"); err != ErrTimeout {
+    t.Fatalf("PutContext without a majority: %v, want ErrTimeout", err)
+  }
+  if d := time.Since(t0); d > 2 * time.Second {
+    t.Fatalf("PutContext returned %v after its deadline", d)
+  }
+
+  cctx, cancel2 := context.WithCancel(ctx)
+  cancel2()
+  if _, err := ck.GetContext(cctx, "a"); err != context.Canceled {
+    t.Fatalf("GetContext after cancel: %v, want context.Canceled", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 func TestHole(t *testing.T) {
   runtime.GOMAXPROCS(4)
 
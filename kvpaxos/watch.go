@@ -0,0 +1,97 @@
+package kvpaxos
+
+//
+// a change feed: every write applied to a key, or to the
+// keys under a prefix, in log order.
+//
+// each replica remembers the last maxChanges writes it has
+// applied. Watch is a long poll: it returns as soon as there
+// are writes at or after FromSeq, or after watchWait with
+// none, and the caller continues from reply.NextSeq. a
+// replica that no longer has the writes from FromSeq (or,
+// having installed a snapshot, never saw them) says
+// ErrCompacted.
+//
+
+import "time"
+import "strings"
+
+// writes remembered for Watch.
+const maxChanges = 10000
+
+// longest a Watch waits for a write.
+const watchWait = time.Second
+
+// call with kv.mu held.
+func (kv *KVPaxos) set(seq int, key string, value string) {
+  kv.db.Put(key, value)
+  kv.record(Event{seq, key, value, false})
+}
+
+// call with kv.mu held.
+func (kv *KVPaxos) remove(seq int, key string) {
+  kv.db.Delete(key)
+  kv.record(Event{seq, key, "", true})
+}
+
+func (kv *KVPaxos) record(e Event) {
+  kv.changes = append(kv.changes, e)
+  if len(kv.changes) <= maxChanges {
+    return
+  }
+  //drop the oldest instance's writes all together, so
+  //that changesFrom stays an instance boundary
+  drop := len(kv.changes) - maxChanges
+  for drop < len(kv.changes) && kv.changes[drop].Seq == kv.changes[drop-1].Seq {
+    drop++
+  }
+  kv.changesFrom = kv.changes[drop-1].Seq + 1
+  kv.changes = append([]Event{}, kv.changes[drop:]...)
+}
+
+func (args *WatchArgs) matches(key string) bool {
+  if args.Prefix {
+    return strings.HasPrefix(key, args.Key)
+  }
+  return key == args.Key
+}
+
+//
+// the matching writes at or after args.FromSeq. call
+// with kv.mu held.
+//
+func (kv *KVPaxos) watched(args *WatchArgs, reply *WatchReply) {
+  reply.Err = OK
+  reply.Events = []Event{}
+  if args.FromSeq < kv.changesFrom {
+    reply.Err = ErrCompacted
+    return
+  }
+  for _, e := range kv.changes {
+    if e.Seq >= args.FromSeq && args.matches(e.Key) {
+      reply.Events = append(reply.Events, e)
+    }
+  }
+  reply.NextSeq = args.FromSeq
+  if kv.currentSeq > reply.NextSeq {
+    reply.NextSeq = kv.currentSeq
+  }
+}
+
+func (kv *KVPaxos) Watch(args *WatchArgs, reply *WatchReply) error {
+  deadline := time.Now().Add(watchWait)
+  for {
+    //the applier keeps db, and so changes, up to date
+    kv.mu.Lock()
+    kv.watched(args, reply)
+    kv.mu.Unlock()
+
+    if reply.Err != OK || len(reply.Events) > 0 {
+      return nil
+    }
+    if kv.dead || time.Now().After(deadline) {
+      return nil
+    }
+    time.Sleep(50 * time.Millisecond)
+  }
+}
@@ -0,0 +1,100 @@
+package paxos
+
+//
+// how a proposer waits between failed rounds, and
+// counters describing how many rounds decisions took.
+//
+// a round is one attempt at phase 1 and phase 2 with a
+// single proposal number. after a failed round the proposer
+// sleeps for a random time between half and all of
+// Min * 2^(rounds-1), capped at Max, so that peers dueling
+// over an instance drift apart instead of pre-empting each
+// other forever. if a rejection shows that another peer
+// holds a higher proposal number, that peer is probably
+// about to succeed, so we wait between one and two times
+// the capped delay instead. that is still random: in a duel
+// each side sees the other's number, and equal waits would
+// keep them in step.
+//
+
+import "time"
+import "math/rand"
+
+type Backoff struct {
+  Min time.Duration // delay after the first failed round
+  Max time.Duration // cap on the delay before jitter
+  MaxRounds int // give up after this many rounds; 0 means never
+}
+
+func DefaultBackoff() Backoff {
+  return Backoff{10 * time.Millisecond, 500 * time.Millisecond, 0}
+}
+
+type Metrics struct {
+  Decisions int // Propose() calls that ended with the instance decided
+  GaveUp int // Propose() calls that ran out of rounds
+  Rounds int // total rounds over all Propose() calls
+  Contended int // rounds that found another peer proposing
+  RoundsPerDecision map[int]int // rounds -> number of decisions that took that many
+  MaxInFlight int // most instances this peer has proposed at once
+}
+
+//
+// how long to sleep after the given number of failed rounds.
+// contended means a rejection named another peer.
+//
+func (b Backoff) delay(rounds int, contended bool) time.Duration {
+  d := b.Min
+  for i := 1; i < rounds && d < b.Max; i++ {
+    d *= 2
+  }
+  if d > b.Max {
+    d = b.Max
+  }
+  if d < 2 {
+    return d
+  }
+  if contended {
+    return d + time.Duration(rand.Int63n(int64(d)))
+  }
+  return d / 2 + time.Duration(rand.Int63n(int64(d / 2)))
+}
+
+//
+// change how this peer's proposers back off. takes
+// effect for rounds that start after the call.
+//
+func (px *Paxos) SetBackoff(b Backoff) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  px.backoff = b
+}
+
+//
+// a copy of this peer's proposer counters.
+//
+func (px *Paxos) Metrics() Metrics {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  m := px.metrics
+  m.RoundsPerDecision = map[int]int{}
+  for rounds, n := range(px.metrics.RoundsPerDecision) {
+    m.RoundsPerDecision[rounds] = n
+  }
+  return m
+}
+
+func (px *Paxos) recordRounds(rounds int, contended int, decided bool) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.metrics.Rounds += rounds
+  px.metrics.Contended += contended
+  if decided {
+    px.metrics.Decisions++
+    px.metrics.RoundsPerDecision[rounds]++
+  } else {
+    px.metrics.GaveUp++
+  }
+}
@@ -0,0 +1,147 @@
+package paxos
+
+//
+// batching layer on top of Start(), so that values
+// proposed close together share one Paxos instance.
+//
+// b = paxos.MakeBatcher(px, maxSize, window)
+// b.Start(v interface{}) -- queue v for agreement in some instance
+// b.Status(seq int) (decided bool, vs []interface{}) -- the values agreed
+//   on in instance seq, in the order every peer will see them
+//
+// the Batcher chooses instance numbers itself. a batch that
+// loses its instance to some other value is proposed again
+// in a later instance, so every value passed to Start()
+// eventually appears in exactly one decided instance.
+// instances decided without a Batcher look like a batch of
+// one to Status(), so batching and non-batching peers can
+// share a log.
+//
+
+import "sync"
+import "time"
+import "math/rand"
+import "encoding/gob"
+
+// the value actually agreed on in a batched instance.
+type Batch struct {
+  ID int64 // tells a proposer whether the decided batch was its own
+  Values []interface{}
+}
+
+type Batcher struct {
+  mu sync.Mutex
+  px *Paxos
+  maxSize int // most values in one batch
+  window time.Duration // how long to collect values before proposing
+  pending []interface{}
+  full chan bool // signalled when pending reaches maxSize
+  flushing bool // a flusher goroutine is running
+  seq int // no instance below this can hold a new batch
+}
+
+func MakeBatcher(px *Paxos, maxSize int, window time.Duration) *Batcher {
+  gob.Register(Batch{})
+
+  b := &Batcher{}
+  b.px = px
+  b.maxSize = maxSize
+  b.window = window
+  b.full = make(chan bool, 1)
+  return b
+}
+
+//
+// queue v to be agreed on. returns right away; the
+// application finds v later by calling Status().
+//
+func (b *Batcher) Start(v interface{}) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  b.pending = append(b.pending, v)
+  if len(b.pending) >= b.maxSize {
+    select {
+    case b.full <- true:
+    default:
+    }
+  }
+  if !b.flushing {
+    b.flushing = true
+    go b.flusher()
+  }
+}
+
+//
+// propose whatever has queued up, one batch at a time,
+// until nothing is left.
+//
+func (b *Batcher) flusher() {
+  select {
+  case <-b.full:
+  case <-time.After(b.window):
+  }
+
+  for {
+    b.mu.Lock()
+    if len(b.pending) == 0 || b.px.dead {
+      b.flushing = false
+      b.mu.Unlock()
+      return
+    }
+    n := len(b.pending)
+    if n > b.maxSize {
+      n = b.maxSize
+    }
+    batch := Batch{rand.Int63(), make([]interface{}, n)}
+    copy(batch.Values, b.pending[:n])
+    b.pending = b.pending[n:]
+    b.mu.Unlock()
+
+    b.propose(batch)
+  }
+}
+
+// keep trying later instances until one decides on batch.
+func (b *Batcher) propose(batch Batch) {
+  for !b.px.dead {
+    seq := b.px.Max() + 1
+    if seq < b.seq {
+      seq = b.seq
+    }
+    b.px.Start(seq, batch)
+    decided, v := b.wait(seq)
+    b.seq = seq + 1
+    if decided {
+      if d, ok := v.(Batch); ok && d.ID == batch.ID {
+        return
+      }
+    }
+  }
+}
+
+func (b *Batcher) wait(seq int) (bool, interface{}) {
+  for !b.px.dead {
+    if decided, v := b.px.WaitDecided(seq, time.Second); decided {
+      return decided, v
+    }
+    if seq < b.px.lockedMin() {
+      break
+    }
+  }
+  return false, nil
+}
+
+//
+// the values decided in instance seq, in order.
+//
+func (b *Batcher) Status(seq int) (bool, []interface{}) {
+  decided, v := b.px.Status(seq)
+  if !decided {
+    return false, nil
+  }
+  if batch, ok := v.(Batch); ok {
+    return true, batch.Values
+  }
+  return true, []interface{}{v}
+}
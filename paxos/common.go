@@ -10,7 +10,8 @@ type Instance struct {
   highestAccepted int
   highestResponded int
   agreed bool
-  value interface{}
+  value interface{} // v_a
+  decided interface{} // the value agreed on, once agreed
 }
 
 //constructor for instances
@@ -20,6 +21,7 @@ func MakeInstance() Instance {
   instance.highestResponded = -1
   instance.agreed = false
   instance.value = nil
+  instance.decided = nil
   return instance
 }
 
@@ -42,7 +44,7 @@ func MakeInstance() Instance {
 
 type PrepareArgs struct {
   Instance int //paxos instance this belongs to
-  Proposal int //proposal number
+  Proposal int //proposal number, round*len(peers) + proposer index
   Done int //max done seen
   Me string //me!
 }
@@ -52,18 +54,49 @@ type PrepareReply struct {
   NextProposalNumber int
   OK bool
   Value interface{}
+  Done int // the acceptor's own Done(), so idle peers still hold Min() up
+}
+
+// phase 1 for instance From and every instance after it,
+// sent by a peer trying to become the stable leader.
+type PrepareAllArgs struct {
+  From int
+  Proposal int
+  Done int
+  Me string
+}
+
+type AcceptedValue struct {
+  Proposal int
+  Value interface{}
+}
+
+type PrepareAllReply struct {
+  OK bool
+  NextProposalNumber int
+  Accepted map[int]AcceptedValue // seq -> (n_a, v_a) for seq >= From
+}
+
+// a promise not to accept proposals numbered below
+// Proposal in any instance >= From.
+type Promise struct {
+  From int
+  Proposal int
 }
 
 type AcceptArgs struct {
   Instance int
   Proposal int
   Value interface{}
+  Done int //max done seen
+  Me string
 }
 
 type AcceptReply struct {
   OK bool
   Proposal int
   NextProposalNumber int
+  Done int // the acceptor's own Done()
 }
 
 type DecidedArgs struct {
@@ -76,3 +109,20 @@ type DecidedReply struct {
   OK bool
   NextProposalNumber int
 }
+
+// ask a peer whether it knows the decision for Instance.
+type LearnArgs struct {
+  Instance int
+}
+
+type LearnReply struct {
+  Decided bool
+  Value interface{}
+}
+
+type HighestArgs struct {
+}
+
+type HighestReply struct {
+  Max int
+}
@@ -0,0 +1,252 @@
+package paxos
+
+//
+// changing the set of peers while the log keeps running.
+//
+// the peer set is itself agreed on through the log. once every
+// peer has called px.SetReconfigWindow(alpha), with the same
+// alpha, a ConfigChange decided in instance i chooses the peers
+// that decide instance i+alpha and every instance after it,
+// until the next ConfigChange takes over.
+//
+// px.SetReconfigWindow(alpha int) -- turn membership changes on
+// px.ProposeConfig(peers []string) int -- agree on a new peer set;
+//   returns the first instance the new peers decide
+// px.PeersFor(seq int) []string -- the peers that decide seq
+// px = paxos.MakeFrom(peers, me, rpcs, first) -- a peer joining
+//   a running group, for instances first onwards
+//
+// to know who decides instance seq, a proposer must know every
+// decision up to seq-alpha, so alpha also bounds how far past
+// the decided prefix proposals can run. a hole in that prefix
+// that no other peer can fill is filled with a nil value, which
+// the application must skip.
+//
+// configurations are kept in memory. a peer restarted from
+// storage rebuilds them from the decided instances it still
+// has, so ConfigChanges must not be forgotten with Done()
+// before every peer is past the instance they take effect at.
+//
+
+import "time"
+import "net/rpc"
+import "encoding/gob"
+
+// the value agreed on to change the peer set.
+type ConfigChange struct {
+  Peers []string
+}
+
+type config struct {
+  start int // first instance these peers decide
+  peers []string
+}
+
+//
+// like Make, for a peer added by ProposeConfig(). peers is the
+// new peer set and first is the instance ProposeConfig()
+// returned; the peer never proposes below first. the caller
+// must also call SetReconfigWindow() with the group's alpha.
+//
+func MakeFrom(peers []string, me int, rpcs *rpc.Server, first int) *Paxos {
+  return makePaxos(peers, me, rpcs, nil, first)
+}
+
+//
+// let the peer set change, with ConfigChanges taking effect
+// alpha instances after they are decided. 0, the default,
+// keeps the peers passed to Make() forever.
+//
+func (px *Paxos) SetReconfigWindow(alpha int) {
+  gob.Register(ConfigChange{})
+
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.alpha = alpha
+  px.configs = px.configs[:1]
+  px.settled = px.configs[0].start - alpha
+  if alpha == 0 {
+    return
+  }
+  for seq, instance := range(px.instances) {
+    if instance.agreed {
+      px.learnConfig(seq, instance.decided)
+    }
+  }
+}
+
+//
+// record the configuration chosen by a decided instance.
+// call with px.mu held.
+//
+func (px *Paxos) learnConfig(seq int, v interface{}) {
+  change, ok := v.(ConfigChange)
+  if !ok || px.alpha == 0 {
+    return
+  }
+  start := seq + px.alpha
+  if start <= px.configs[0].start {
+    //decided before we joined
+    return
+  }
+
+  //decisions can arrive out of order
+  i := len(px.configs)
+  for i > 0 && px.configs[i-1].start > start {
+    i--
+  }
+  if px.configs[i-1].start == start {
+    return
+  }
+  px.configs = append(px.configs, config{})
+  copy(px.configs[i+1:], px.configs[i:])
+  px.configs[i] = config{start, change.Peers}
+}
+
+// call with px.mu held.
+func (px *Paxos) configFor(seq int) config {
+  i := len(px.configs) - 1
+  for i > 0 && px.configs[i].start > seq {
+    i--
+  }
+  return px.configs[i]
+}
+
+func (px *Paxos) PeersFor(seq int) []string {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.configFor(seq).peers
+}
+
+// which configuration instance belongs to.
+func (px *Paxos) epochOf(instance int) int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.configFor(instance).start
+}
+
+// every peer in every configuration we know of.
+func (px *Paxos) allPeers() []string {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  seen := map[string]bool{}
+  peers := []string{}
+  for _, c := range(px.configs) {
+    for _, peer := range(c.peers) {
+      if !seen[peer] {
+        seen[peer] = true
+        peers = append(peers, peer)
+      }
+    }
+  }
+  return peers
+}
+
+func indexOf(peer string, peers []string) int {
+  for i, p := range(peers) {
+    if p == peer {
+      return i
+    }
+  }
+  return -1
+}
+
+//
+// the peers that decide instance, and whether we are one
+// of them. waits until the configuration for instance is
+// known, i.e. every instance up to instance-alpha is decided.
+//
+func (px *Paxos) proposers(instance int) ([]string, bool) {
+  px.mu.Lock()
+  alpha := px.alpha
+  px.mu.Unlock()
+  if alpha > 0 {
+    px.settle(instance - alpha)
+  }
+
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if instance < px.configs[0].start {
+    return nil, false
+  }
+  c := px.configFor(instance)
+  return c.peers, indexOf(px.self, c.peers) >= 0
+}
+
+//
+// wait until every instance up to upto is decided here,
+// fetching decisions we missed and filling holes nobody
+// else will fill.
+//
+func (px *Paxos) settle(upto int) {
+  for !px.dead {
+    px.mu.Lock()
+    if min := px.Min(); px.settled < min {
+      px.settled = min
+    }
+    for px.settled <= upto {
+      instance, found := px.instances[px.settled]
+      if !found || !instance.agreed {
+        break
+      }
+      px.settled++
+    }
+    next := px.settled
+    delay := px.backoff.Min
+    px.mu.Unlock()
+
+    if next > upto {
+      return
+    }
+    if px.Fetch(next) {
+      continue
+    }
+    //give the instance's own proposer a chance first
+    time.Sleep(delay)
+    if !px.Fetch(next) {
+      px.Propose(next, nil)
+    }
+  }
+}
+
+//
+// agree on a new set of peers. returns the first instance
+// they decide, or -1 if membership changes are off or this
+// peer is killed first. peers being added should be started
+// with MakeFrom() and that instance.
+//
+func (px *Paxos) ProposeConfig(peers []string) int {
+  px.mu.Lock()
+  alpha := px.alpha
+  px.mu.Unlock()
+  if alpha == 0 {
+    return -1
+  }
+
+  for !px.dead {
+    seq := px.Max() + 1
+    px.Start(seq, ConfigChange{peers})
+    decided, v := px.WaitDecided(seq, time.Second)
+    for !decided && !px.dead && seq >= px.lockedMin() {
+      decided, v = px.WaitDecided(seq, time.Second)
+    }
+    if change, ok := v.(ConfigChange); ok && samePeers(change.Peers, peers) {
+      return seq + alpha
+    }
+  }
+  return -1
+}
+
+func samePeers(a []string, b []string) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range(a) {
+    if a[i] != b[i] {
+      return false
+    }
+  }
+  return true
+}
@@ -0,0 +1,183 @@
+package paxos
+
+//
+// catch-up for peers that missed decisions.
+//
+// a peer that was partitioned away while an instance was
+// decided never hears the Decided message. rather than wait
+// for some proposer to run that instance again, it can ask:
+//
+// px.Fetch(seq int) bool -- ask the other peers whether seq was
+//   decided, and if one says yes, learn the value locally
+// px.MaxAccepted() int -- the highest instance this peer has
+//   accepted a value for or seen decided. unlike Max(), this
+//   ignores instances that Status() merely asked about
+// px.ReadIndex() (seq int, ok bool) -- the highest MaxAccepted() of a
+//   majority. every value decided before ReadIndex() was
+//   called is at seq or below, so an application that has applied
+//   everything up to seq can answer a read without a new instance
+//
+// each peer also runs a background task that looks for holes,
+// undecided instances between Min() and Max(), and fetches
+// them. a hole is only fetched once it has survived a whole
+// scan, so instances that are merely in progress don't cost
+// any RPCs, and a hole that nobody can fill is retried less
+// and less often.
+//
+
+import "time"
+
+const catchUpInterval = 500 * time.Millisecond
+
+// longest wait, in scans, between fetches of one hole.
+const maxHoleBackoff = 32
+
+//
+// report whether instance has been decided here. unlike
+// Status(), this must not create state for instances we
+// have never heard of.
+//
+func (px *Paxos) Learn(args *LearnArgs, reply *LearnReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  reply.Decided = false
+  if instance, found := px.instances[args.Instance]; found && instance.agreed {
+    reply.Decided = true
+    reply.Value = instance.decided
+  }
+  return nil
+}
+
+func (px *Paxos) Fetch(seq int) bool {
+  if decided, _ := px.Status(seq); decided {
+    return true
+  }
+  args := &LearnArgs{seq}
+  for _, peer := range(px.allPeers()) {
+    if peer == px.self {
+      continue
+    }
+    var reply LearnReply
+    ok := call(peer, "Paxos.Learn", args, &reply)
+    if ok && reply.Decided {
+      //a decided value is final, so one peer's word is enough
+      var dreply DecidedReply
+      px.Decided(&DecidedArgs{seq, -1, reply.Value}, &dreply)
+      return true
+    }
+  }
+  return false
+}
+
+//
+// instances below Min() count as seen, since they were
+// decided before every peer called Done() on them.
+//
+func (px *Paxos) MaxAccepted() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  max := px.Min() - 1
+  for seq, instance := range(px.instances) {
+    if seq > max && (instance.agreed || instance.highestAccepted >= 0) {
+      max = seq
+    }
+  }
+  return max
+}
+
+func (px *Paxos) Highest(args *HighestArgs, reply *HighestReply) error {
+  reply.Max = px.MaxAccepted()
+  return nil
+}
+
+//
+// a decided value was accepted by a majority, and every
+// acceptor keeps state for what it accepted until all peers
+// are Done() with it, so any majority includes a peer whose
+// MaxAccepted() is at least as high. ok is false if no
+// majority of the newest configuration answered.
+//
+func (px *Paxos) ReadIndex() (int, bool) {
+  px.mu.Lock()
+  peers := px.configs[len(px.configs) - 1].peers
+  px.mu.Unlock()
+
+  highest := -1
+  answered := 0
+  for _, peer := range(peers) {
+    var reply HighestReply
+    if peer == px.self {
+      px.Highest(&HighestArgs{}, &reply)
+    } else if !call(peer, "Paxos.Highest", &HighestArgs{}, &reply) {
+      continue
+    }
+    answered++
+    if reply.Max > highest {
+      highest = reply.Max
+    }
+  }
+  return highest, answered > len(peers) / 2
+}
+
+//
+// undecided instances between Min() and Max().
+//
+func (px *Paxos) holes() []int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  max := -1
+  for seq := range(px.instances) {
+    if seq > max {
+      max = seq
+    }
+  }
+  holes := []int{}
+  for seq := px.Min(); seq < max; seq++ {
+    if instance, found := px.instances[seq]; !found || !instance.agreed {
+      holes = append(holes, seq)
+    }
+  }
+  return holes
+}
+
+func (px *Paxos) catchUp() {
+  // seq -> scans to skip before the next fetch; present
+  // only for holes seen on an earlier scan
+  wait := map[int]int{}
+  backoff := map[int]int{}
+
+  for px.dead == false {
+    time.Sleep(catchUpInterval)
+
+    current := map[int]bool{}
+    for _, seq := range(px.holes()) {
+      current[seq] = true
+      if _, seen := wait[seq]; !seen {
+        wait[seq] = 0
+        backoff[seq] = 1
+        continue
+      }
+      if wait[seq] > 0 {
+        wait[seq]--
+        continue
+      }
+      if !px.Fetch(seq) {
+        if backoff[seq] < maxHoleBackoff {
+          backoff[seq] *= 2
+        }
+        wait[seq] = backoff[seq]
+      }
+    }
+
+    // forget holes that were filled or garbage collected.
+    for seq := range(wait) {
+      if !current[seq] {
+        delete(wait, seq)
+        delete(backoff, seq)
+      }
+    }
+  }
+}
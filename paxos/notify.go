@@ -0,0 +1,133 @@
+package paxos
+
+//
+// push-based alternatives to polling Status().
+//
+// px.WaitDecided(seq int, timeout time.Duration) (decided bool, v interface{})
+//   -- like Peek(), but first waits up to timeout for seq to be decided
+// px.Subscribe(fromSeq int) (ch <-chan Decision, cancel func())
+//   -- every decided instance from fromSeq on, in order, as soon as
+//      this peer learns it
+//
+
+import "time"
+import "sync"
+
+type Decision struct {
+  Seq int
+  Value interface{}
+}
+
+//
+// wake up anyone waiting for instance seq.
+// call with px.mu held.
+//
+func (px *Paxos) notify(seq int) {
+  for _, ch := range(px.waiters[seq]) {
+    close(ch)
+  }
+  delete(px.waiters, seq)
+}
+
+func (px *Paxos) WaitDecided(seq int, timeout time.Duration) (bool, interface{}) {
+  px.mu.Lock()
+  if px.Min() > seq {
+    px.mu.Unlock()
+    return false, nil
+  }
+  if instance, found := px.instances[seq]; found && instance.agreed {
+    px.mu.Unlock()
+    return true, instance.decided
+  }
+  ch := make(chan bool)
+  px.waiters[seq] = append(px.waiters[seq], ch)
+  px.mu.Unlock()
+
+  select {
+  case <-ch:
+  case <-time.After(timeout):
+    px.mu.Lock()
+    px.unwait(seq, ch)
+    px.mu.Unlock()
+  }
+  return px.Peek(seq)
+}
+
+//
+// an instance below min is forgotten and will never be
+// decided here, so wake its waiters rather than keep them
+// around. call with px.mu held.
+//
+func (px *Paxos) dropWaiters(min int) {
+  for seq := range(px.waiters) {
+    if seq < min {
+      px.notify(seq)
+    }
+  }
+}
+
+//
+// stop waiting on ch for instance seq, so a wait that
+// timed out leaves nothing behind. call with px.mu held.
+//
+func (px *Paxos) unwait(seq int, ch chan bool) {
+  waiting := px.waiters[seq]
+  for i := range(waiting) {
+    if waiting[i] == ch {
+      waiting = append(waiting[:i], waiting[i+1:]...)
+      break
+    }
+  }
+  if len(waiting) == 0 {
+    delete(px.waiters, seq)
+  } else {
+    px.waiters[seq] = waiting
+  }
+}
+
+//
+// deliver decisions in order on the returned channel until
+// cancel() is called or the peer is killed. if the next
+// instance has already been forgotten (see Done()), there is
+// no way to deliver it in order, so the channel is closed.
+//
+func (px *Paxos) Subscribe(fromSeq int) (<-chan Decision, func()) {
+  ch := make(chan Decision)
+  stop := make(chan bool)
+  var once sync.Once
+  cancel := func() {
+    once.Do(func() { close(stop) })
+  }
+
+  go func() {
+    defer close(ch)
+    for seq := fromSeq; !px.dead; {
+      decided, v := px.WaitDecided(seq, time.Second)
+      if !decided {
+        if seq < px.lockedMin() {
+          return
+        }
+        select {
+        case <-stop:
+          return
+        default:
+        }
+        continue
+      }
+      select {
+      case ch <- Decision{seq, v}:
+        seq++
+      case <-stop:
+        return
+      }
+    }
+  }()
+
+  return ch, cancel
+}
+
+func (px *Paxos) lockedMin() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.Min()
+}
@@ -6,18 +6,35 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers is fixed, unless the application agrees
+// on a new one through the log (see config.go).
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// Peers made with MakeWithStorage write their acceptor state
+// to disk before replying, so they can handle crash+restart;
+// peers made with Make keep everything in memory.
 //
 // The application interface:
 //
 // px = paxos.Make(peers []string, me string)
+// px = paxos.MakeWithStorage(peers []string, me string, rpcs, dir string)
 // px.Start(seq int, v interface{}) -- start agreement on new instance
 // px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
+// px.Peek(seq int) (decided bool, v interface{}) -- Status(), without creating the instance
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.WaitDecided(seq int, timeout) -- Peek(), once seq is decided or timeout passes
+// px.Subscribe(fromSeq int) -- channel of decided values, in order
+// px.Fetch(seq int) bool -- ask other peers for a decision we missed
+// px.MaxAccepted() int -- highest instance accepted or decided here, or -1
+// px.ReadIndex() (int, bool) -- everything decided so far is at or below this
+// px.SetReconfigWindow(alpha int) -- allow the peer set to change
+// px.ProposeConfig(peers []string) int -- agree on a new peer set
+// px.SetLeaderMode(on bool) -- skip phase 1 while this peer stays leader
+// px.Leader() string -- the stable leader this peer last heard from
+// px.SetBackoff(b Backoff) -- how proposers wait between failed rounds
+// px.SetWindow(n int) -- how many instances may be proposed at once
+// px.Metrics() Metrics -- how many rounds decisions have taken
 //
 
 import "net"
@@ -40,13 +57,44 @@ type Paxos struct {
   rpcCount int
   peers []string
   me int // index into peers[]
+  self string // peers[me]
 
 
   // Your data here.
   instances map[int]Instance
   maxPeerDones map[string]int
-  pLock sync.Mutex
+  pLock sync.Mutex // guards the stable-leader state below
+  storage Storage // nil if acceptor state is not persisted
 
+  //acceptor: promise covering every instance >= promisedFrom
+  promised int
+  promisedFrom int
+
+  //proposer: while ballot >= 0 we hold a promise for
+  //every instance >= ballotFrom and skip phase 1
+  leaderMode bool
+  ballot int
+  ballotFrom int
+  ballotEpoch int // start of the configuration ballot was won in
+  leaderValues map[int]interface{} // seq -> the one value ballot carries for seq
+
+  backoff Backoff
+  metrics Metrics
+
+  waiters map[int][]chan bool // seq -> closed when seq is decided
+
+  //pipelining: at most window instances are proposed at
+  //once, and each by at most one Propose() on this peer
+  window int
+  inflight int
+  proposing map[int]bool
+  slotFree *sync.Cond // on mu, signalled when inflight drops
+
+  //membership: configs[i] decides instances from
+  //configs[i].start up to configs[i+1].start
+  alpha int // 0 means the peer set never changes
+  configs []config
+  settled int // every instance below this is decided here
 }
 
 // proposer(v):
@@ -68,108 +116,489 @@ type Paxos struct {
 func (px *Paxos) Propose(instance int, value interface{}) {
 //   choose n, unique and higher than any n seen so far
 //   send prepare(n) to all servers including self
-  //lock up
-  px.pLock.Lock()
-  defer px.pLock.Unlock()
+  //who decides this instance? peers outside its
+  //configuration can only learn the outcome
+  peers, member := px.proposers(instance)
+  if !member {
+    px.Fetch(instance)
+    return
+  }
+
+  //take one of the window's slots
+  if !px.beginProposal(instance) {
+    return
+  }
+  defer px.endProposal(instance)
+
+  //a stable leader already holds a prepare for this
+  //instance, so it can go straight to phase 2, unless
+  //another Start() of it has already finished
+  if px.isDecided(instance) {
+    return
+  }
+  if ballot, v, ok := px.leaderBallot(instance, value); ok {
+    if px.proposeAsLeader(instance, peers, ballot, v) {
+      px.recordRounds(1, 0, true)
+      return
+    }
+    px.stepDown(ballot)
+  }
   
   proposal := 0
   next := -1
   proposalDone := false
-  for !proposalDone {
-    next += 1
-    proposal = next
+  rounds := 0
+  contended := 0
+  for !proposalDone && !px.dead && !px.isDecided(instance) {
+    rounds++
+    proposal = px.proposalAbove(next, peers)
+    next = proposal
     
-    replies := list.New()
-    quorum := len(px.peers) / 2
+//   if prepare_ok(n_a, v_a) from majority:
+    var prepared bool
+    var maxProposalValue interface{}
+    var highest int
+    if px.inLeaderMode() {
+      prepared, maxProposalValue, highest = px.prepareAll(instance, peers, proposal, value)
+    } else {
+      prepared, maxProposalValue, highest = px.prepare(instance, peers, proposal, value)
+    }
+    next = int(math.Max(float64(next), float64(highest)))
     
-    for _, peer := range px.peers {
-      prepareArgs := &PrepareArgs{instance, proposal, px.maxPeerDones[px.peers[px.me]], px.peers[px.me]}
-      var reply PrepareReply = PrepareReply{}
-      if peer != px.peers[px.me]{
-        ok := call(peer, "Paxos.Prepare", prepareArgs, &reply)
-        if ok {
-          replies.PushBack(reply)
-        }
+    //did we reach quorum?
+    if prepared {
+//     v' = v_a with highest n_a; choose own v otherwise
+//     send accept(n, v') to all
+      accepted, highest := px.accept(instance, peers, proposal, maxProposalValue)
+      next = int(math.Max(float64(next), float64(highest)))
+//     if accept_ok(n) from majority:
+//       send decided(v') to all
+      if accepted {
+        px.decide(instance, peers, proposal, maxProposalValue)
+        proposalDone = true
       } else {
-        px.Prepare(prepareArgs, &reply)
+        px.stepDown(proposal)
+      }
+    } 
+
+    if !proposalDone {
+      //a rejection carrying a higher number names the peer
+      //that is proposing over us
+      busy := next > proposal && next % len(peers) != indexOf(px.self, peers)
+      if busy {
+        contended++
+      }
+      px.mu.Lock()
+      backoff := px.backoff
+      px.mu.Unlock()
+      if backoff.MaxRounds > 0 && rounds >= backoff.MaxRounds {
+        break
+      }
+      time.Sleep(backoff.delay(rounds, busy))
+    }
+  }
+  px.recordRounds(rounds, contended, proposalDone || px.isDecided(instance))
+}
+
+//
+// wait for a free slot in the window. returns false if
+// this peer is already proposing instance, or has died.
+//
+func (px *Paxos) beginProposal(instance int) bool {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  if px.proposing[instance] {
+    return false
+  }
+  px.proposing[instance] = true
+  for px.inflight >= px.window && !px.dead {
+    px.slotFree.Wait()
+  }
+  if px.dead {
+    delete(px.proposing, instance)
+    return false
+  }
+  px.inflight++
+  if px.inflight > px.metrics.MaxInFlight {
+    px.metrics.MaxInFlight = px.inflight
+  }
+  return true
+}
+
+func (px *Paxos) endProposal(instance int) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  delete(px.proposing, instance)
+  px.inflight--
+  px.slotFree.Broadcast()
+}
+
+//
+// how many instances this peer may be proposing at once.
+// 1 turns pipelining off.
+//
+func (px *Paxos) SetWindow(window int) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.window = window
+  px.slotFree.Broadcast()
+}
+
+// the Done() value to piggyback on our own messages.
+func (px *Paxos) myDone() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.doneOf(px.self)
+}
+
+// highest Done() heard from peer, or -1.
+func (px *Paxos) doneOf(peer string) int {
+  if done, found := px.maxPeerDones[peer]; found {
+    return done
+  }
+  return -1
+}
+
+//
+// has this peer learned the outcome of instance, or
+// forgotten it? either way there is nothing to propose.
+//
+func (px *Paxos) isDecided(instance int) bool {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if instance < px.Min() {
+    return true
+  }
+  inst, found := px.instances[instance]
+  return found && inst.agreed
+}
+
+//
+// phase 1 for a single instance. returns whether a majority
+// promised, the value to propose, and the highest proposal
+// number any acceptor told us about when rejecting.
+//
+func (px *Paxos) prepare(instance int, peers []string, proposal int, value interface{}) (bool, interface{}, int) {
+  replies := list.New()
+  quorum := len(peers) / 2
+  done := px.myDone()
+  
+  for _, peer := range peers {
+    prepareArgs := &PrepareArgs{instance, proposal, done, px.self}
+    var reply PrepareReply = PrepareReply{}
+    if peer != px.self {
+      ok := call(peer, "Paxos.Prepare", prepareArgs, &reply)
+      if ok {
+        px.heardReply(peer, reply.Done)
         replies.PushBack(reply)
       }
+    } else {
+      px.Prepare(prepareArgs, &reply)
+      replies.PushBack(reply)
     }
+  }
 
-//   if prepare_ok(n_a, v_a) from majority:
-    prepareReplyCount := 0
-    maxProposal := -1
-    maxProposalValue := value
-    for e := replies.Front(); e != nil; e = e.Next(){
-      reply := e.Value.(PrepareReply)
-      if reply.OK {
-        prepareReplyCount++
-        if reply.MaxProposalAcceptedSoFar > maxProposal{
-          maxProposal = reply.MaxProposalAcceptedSoFar
-          maxProposalValue = reply.Value
-        }
-      } else {
-        next = int(math.Max(float64(next), float64(reply.NextProposalNumber)))
+  prepareReplyCount := 0
+  maxProposal := -1
+  maxProposalValue := value
+  next := -1
+  for e := replies.Front(); e != nil; e = e.Next(){
+    reply := e.Value.(PrepareReply)
+    if reply.OK {
+      prepareReplyCount++
+      if reply.MaxProposalAcceptedSoFar > maxProposal{
+        maxProposal = reply.MaxProposalAcceptedSoFar
+        maxProposalValue = reply.Value
       }
+    } else {
+      next = int(math.Max(float64(next), float64(reply.NextProposalNumber)))
     }
-    
-    replies = list.New()
-    
-    //did we reach quorum?
-    if (prepareReplyCount > quorum) {
-//     v' = v_a with highest n_a; choose own v otherwise
-//     send accept(n, v') to all
-      for _, peer := range px.peers {
-        acceptArgs := &AcceptArgs{instance, proposal, maxProposalValue}
-        var reply AcceptReply = AcceptReply{}
-        if peer != px.peers[px.me] {
-          ok := call(peer, "Paxos.Accept", acceptArgs, &reply)
-          if ok {
-            replies.PushBack(reply)
-          }
-        } else {
-          px.Accept(acceptArgs, &reply)
-          replies.PushBack(reply)
-        }
+  }
+  return prepareReplyCount > quorum, maxProposalValue, next
+}
+
+//
+// phase 1 for instance and every instance after it. on
+// success this peer becomes the stable leader: it remembers
+// the proposal number, and the values it is obliged to
+// re-propose for later instances, so that proposeAsLeader
+// can skip phase 1 until some other proposer pre-empts it.
+//
+func (px *Paxos) prepareAll(instance int, peers []string, proposal int, value interface{}) (bool, interface{}, int) {
+  replies := list.New()
+  quorum := len(peers) / 2
+  done := px.myDone()
+
+  for _, peer := range peers {
+    prepareArgs := &PrepareAllArgs{instance, proposal, done, px.self}
+    var reply PrepareAllReply = PrepareAllReply{}
+    if peer != px.self {
+      ok := call(peer, "Paxos.PrepareAll", prepareArgs, &reply)
+      if ok {
+        replies.PushBack(reply)
       }
+    } else {
+      px.PrepareAll(prepareArgs, &reply)
+      replies.PushBack(reply)
+    }
+  }
 
-      var accepted = 0
-      for e := replies.Front(); e != nil; e = e.Next() {
-        reply := e.Value.(AcceptReply)
-        if reply.OK {
-          accepted++
-        } else {
-          next = int(math.Max(float64(next), float64(reply.NextProposalNumber)))
+  prepareReplyCount := 0
+  next := -1
+  maxAccepted := map[int]AcceptedValue{}
+  for e := replies.Front(); e != nil; e = e.Next(){
+    reply := e.Value.(PrepareAllReply)
+    if reply.OK {
+      prepareReplyCount++
+      for seq, a := range(reply.Accepted) {
+        if old, found := maxAccepted[seq]; !found || a.Proposal > old.Proposal {
+          maxAccepted[seq] = a
         }
       }
-//     if accept_ok(n) from majority:
-//       send decided(v') to all
-      if accepted > quorum {
-        decidedArgs := &DecidedArgs{instance, proposal, maxProposalValue}
-        var reply DecidedReply
-        for _, peer := range px.peers {
-          if peer != px.peers[px.me]{
-            call(peer, "Paxos.Decided", decidedArgs, &reply)
-          } else {
-            px.Decided(decidedArgs, &reply)
-          }
-        }
-        proposalDone = true
+    } else {
+      next = int(math.Max(float64(next), float64(reply.NextProposalNumber)))
+    }
+  }
+  if prepareReplyCount <= quorum {
+    return false, value, next
+  }
+
+  maxProposalValue := value
+  if a, found := maxAccepted[instance]; found {
+    maxProposalValue = a.Value
+  }
+  delete(maxAccepted, instance)
+
+  //a concurrent prepareAll may have won with a higher number
+  epoch := px.epochOf(instance)
+  px.pLock.Lock()
+  if proposal > px.ballot || epoch != px.ballotEpoch {
+    px.ballot = proposal
+    px.ballotFrom = instance + 1
+    px.ballotEpoch = epoch
+    px.leaderValues = map[int]interface{}{}
+    for seq, a := range(maxAccepted) {
+      px.leaderValues[seq] = a.Value
+    }
+  }
+  px.pLock.Unlock()
+  return true, maxProposalValue, next
+}
+
+// phase 2. returns whether a majority accepted.
+func (px *Paxos) accept(instance int, peers []string, proposal int, value interface{}) (bool, int) {
+  replies := list.New()
+  quorum := len(peers) / 2
+  done := px.myDone()
+
+  for _, peer := range peers {
+    acceptArgs := &AcceptArgs{instance, proposal, value, done, px.self}
+    var reply AcceptReply = AcceptReply{}
+    if peer != px.self {
+      ok := call(peer, "Paxos.Accept", acceptArgs, &reply)
+      if ok {
+        px.heardReply(peer, reply.Done)
+        replies.PushBack(reply)
       }
-    } 
-    time.Sleep(10*time.Millisecond)   
+    } else {
+      px.Accept(acceptArgs, &reply)
+      replies.PushBack(reply)
+    }
+  }
+
+  var accepted = 0
+  next := -1
+  for e := replies.Front(); e != nil; e = e.Next() {
+    reply := e.Value.(AcceptReply)
+    if reply.OK {
+      accepted++
+    } else {
+      next = int(math.Max(float64(next), float64(reply.NextProposalNumber)))
+    }
+  }
+  return accepted > quorum, next
+}
+
+// tell everyone, including ourselves, what was decided.
+func (px *Paxos) decide(instance int, peers []string, proposal int, value interface{}) {
+  decidedArgs := &DecidedArgs{instance, proposal, value}
+  var reply DecidedReply
+  for _, peer := range peers {
+    if peer != px.self {
+      call(peer, "Paxos.Decided", decidedArgs, &reply)
+    } else {
+      px.Decided(decidedArgs, &reply)
+    }
+  }
+}
+
+func (px *Paxos) inLeaderMode() bool {
+  px.pLock.Lock()
+  defer px.pLock.Unlock()
+  return px.leaderMode
+}
+
+//
+// if we are the stable leader for instance, the proposal
+// number to use and the value we are obliged to propose:
+// one an acceptor reported in prepareAll, or else the first
+// value any Propose() of instance offered under this ballot.
+// a ballot must never carry two values for one instance.
+//
+func (px *Paxos) leaderBallot(instance int, value interface{}) (int, interface{}, bool) {
+  epoch := px.epochOf(instance)
+  px.pLock.Lock()
+  defer px.pLock.Unlock()
+
+  if !px.leaderMode || px.ballot < 0 || instance < px.ballotFrom {
+    return -1, value, false
+  }
+  //our promises came from one configuration's acceptors
+  if epoch != px.ballotEpoch {
+    return -1, value, false
+  }
+  if v, found := px.leaderValues[instance]; found {
+    value = v
+  } else {
+    px.leaderValues[instance] = value
   }
+  return px.ballot, value, true
+}
+
+//
+// phase 2 and the decision only, using the proposal number
+// from our last successful prepareAll. returns false if an
+// acceptor has since promised a higher proposal.
+//
+func (px *Paxos) proposeAsLeader(instance int, peers []string, ballot int, value interface{}) bool {
+  accepted, _ := px.accept(instance, peers, ballot, value)
+  if !accepted {
+    return false
+  }
+  px.decide(instance, peers, ballot, value)
+  return true
+}
+
+//
+// we've been pre-empted; go back to running phase 1,
+// unless a newer prepareAll has already replaced ballot.
+//
+func (px *Paxos) stepDown(ballot int) {
+  px.pLock.Lock()
+  defer px.pLock.Unlock()
+  if px.ballot == ballot {
+    px.ballot = -1
+    px.leaderValues = nil
+  }
+}
+
+//
+// turn stable-leader (Multi-Paxos) mode on or off. when on,
+// phase 1 covers the proposed instance and all later ones,
+// so a peer that keeps proposing uncontested only pays for
+// accepts and decides on subsequent instances.
+//
+func (px *Paxos) SetLeaderMode(on bool) {
+  px.pLock.Lock()
+  defer px.pLock.Unlock()
+  px.leaderMode = on
+  px.ballot = -1
+  px.leaderValues = nil
+}
+
+//
+// the peer this peer last promised to follow as stable
+// leader, or "" if none. only a hint: that peer may have
+// been pre-empted since, or died.
+//
+func (px *Paxos) Leader() string {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if px.promised < 0 {
+    return ""
+  }
+  peers := px.configFor(px.promisedFrom).peers
+  return peers[px.promised % len(peers)]
+}
+
+//
+// the smallest proposal number greater than n that belongs
+// to this peer. numbers are round*len(peers) + me, where
+// peers is the configuration deciding the instance, so two
+// peers never choose the same one, and the owner of any
+// number is peers[number % len(peers)].
+//
+func (px *Paxos) proposalAbove(n int, peers []string) int {
+  npeers := len(peers)
+  proposal := (n / npeers) * npeers + indexOf(px.self, peers)
+  if proposal <= n {
+    proposal += npeers
+  }
+  return proposal
 }
 
 func (px *Paxos) GetPaxosState(seq int) Instance {
-  if instance, found := px.instances[seq]; found {
-    return instance
+  instance, found := px.instances[seq]
+  if !found {
+    instance = MakeInstance()
+  }
+  //fold in any promise made to a stable leader
+  if seq >= px.promisedFrom && px.promised > instance.highestResponded {
+    instance.highestResponded = px.promised
   }
-  px.instances[seq] = MakeInstance()
-  instance := px.instances[seq]
+  px.instances[seq] = instance
   return instance
 }
 
+//
+// write an instance's acceptor state to storage, if there
+// is any. returns false if it could not be made durable,
+// in which case the caller must not act on the new state.
+//
+func (px *Paxos) saveInstance(seq int, instance Instance) bool {
+  if px.storage == nil || px.dead {
+    return px.storage == nil
+  }
+  if err := px.storage.SaveInstance(seq, instance); err != nil {
+    log.Printf("Paxos(%v) save instance %v: %v", px.me, seq, err)
+    return false
+  }
+  return true
+}
+
+func (px *Paxos) savePromise(from int, proposal int) bool {
+  if px.storage == nil || px.dead {
+    return px.storage == nil
+  }
+  if err := px.storage.SavePromise(Promise{from, proposal}); err != nil {
+    log.Printf("Paxos(%v) save promise: %v", px.me, err)
+    return false
+  }
+  return true
+}
+
+func (px *Paxos) saveDone(peer string, done int) {
+  if px.storage == nil || px.dead {
+    return
+  }
+  if err := px.storage.SaveDone(peer, done); err != nil {
+    log.Printf("Paxos(%v) save done %v: %v", px.me, peer, err)
+  }
+}
+
+// drop forgotten instances from storage too.
+func (px *Paxos) compact() {
+  if px.storage == nil || px.dead {
+    return
+  }
+  if err := px.storage.Compact(px.instances, px.maxPeerDones, Promise{px.promisedFrom, px.promised}); err != nil {
+    log.Printf("Paxos(%v) compact: %v", px.me, err)
+  }
+}
+
 // acceptor's prepare(n) handler:
 //   if n > n_p
 //     n_p = n
@@ -181,21 +610,23 @@ func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
   px.mu.Lock()
   defer px.mu.Unlock()
   
-  px.maxPeerDones[args.Me] = int(math.Max(float64(px.maxPeerDones[args.Me]), float64(args.Done)))
-  
-  //garbage collecting
-  min := px.Min()
-  for instance := range(px.instances) {
-    if min > instance {
-      delete(px.instances, instance)
-    }
-  }
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.doneOf(px.self)
 
   reply.OK = false
+  //every peer is Done() with a forgotten instance, so it
+  //must not be decided again, perhaps differently
+  if args.Instance < px.Min() {
+    return nil
+  }
   instance := px.GetPaxosState(args.Instance)
   if instance.highestResponded < args.Proposal {
     instance.highestResponded = args.Proposal
 
+    //the promise must be on disk before we make it
+    if !px.saveInstance(args.Instance, instance) {
+      return nil
+    }
     px.instances[args.Instance] = instance
     reply.MaxProposalAcceptedSoFar = instance.highestAccepted
     reply.Value = instance.value
@@ -207,6 +638,95 @@ func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
   return nil
 }
 
+// a Done() value piggybacked on an acceptor's reply.
+func (px *Paxos) heardReply(peer string, done int) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  px.heardDone(peer, done)
+}
+
+//
+// record the Done() value piggybacked on a prepare,
+// and forget whatever that lets us forget.
+//
+func (px *Paxos) heardDone(peer string, done int) {
+  if done > px.doneOf(peer) {
+    px.maxPeerDones[peer] = done
+    px.saveDone(peer, done)
+  }
+  
+  //garbage collecting
+  min := px.Min()
+  for instance := range(px.instances) {
+    if min > instance {
+      delete(px.instances, instance)
+    }
+  }
+  px.dropWaiters(min)
+  px.forgetLeaderValues(min)
+  px.compact()
+}
+
+//
+// the values a stable leader sent for instances below min
+// are no longer needed. call with px.mu held.
+//
+func (px *Paxos) forgetLeaderValues(min int) {
+  px.pLock.Lock()
+  defer px.pLock.Unlock()
+  for seq := range(px.leaderValues) {
+    if seq < min {
+      delete(px.leaderValues, seq)
+    }
+  }
+}
+
+// acceptor's prepare(n, seq) handler for a stable leader:
+//   if n > n_p for every instance >= seq
+//     n_p = n for every instance >= seq, including ones not yet seen
+//     reply prepare_ok with (n_a, v_a) of every instance >= seq
+//   else
+//     reply prepare_reject
+func (px *Paxos) PrepareAll(args *PrepareAllArgs, reply *PrepareAllReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.heardDone(args.Me, args.Done)
+
+  reply.OK = false
+  highest := px.promised
+  for seq, instance := range(px.instances) {
+    if seq >= args.From && instance.highestResponded > highest {
+      highest = instance.highestResponded
+    }
+  }
+  if args.Proposal <= highest {
+    reply.NextProposalNumber = highest
+    return nil
+  }
+
+  //promising more instances than asked for is always safe,
+  //so an older promise's range is kept
+  from := args.From
+  if px.promised >= 0 && px.promisedFrom < from {
+    from = px.promisedFrom
+  }
+  if !px.savePromise(from, args.Proposal) {
+    return nil
+  }
+  px.promised = args.Proposal
+  px.promisedFrom = from
+
+  reply.Accepted = map[int]AcceptedValue{}
+  for seq, instance := range(px.instances) {
+    if seq >= args.From && instance.highestAccepted >= 0 {
+      reply.Accepted[seq] = AcceptedValue{instance.highestAccepted, instance.value}
+    }
+  }
+  reply.OK = true
+  return nil
+}
+
 // Phase 2.
 // (a) If the proposer receives a response to its prepare requests
 //     (numbered n) from a majority of acceptors, then it sends an accept
@@ -231,12 +751,23 @@ func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
   px.mu.Lock()
   defer px.mu.Unlock()
   
+  //a stable leader skips prepares, so Done() values
+  //ride on accepts as well
+  px.heardDone(args.Me, args.Done)
+  reply.Done = px.doneOf(px.self)
+
   reply.OK = false
+  if args.Instance < px.Min() {
+    return nil
+  }
   instance := px.GetPaxosState(args.Instance)
   if instance.highestResponded <= args.Proposal {
     instance.highestResponded = args.Proposal
     instance.highestAccepted = args.Proposal
     instance.value = args.Value
+    if !px.saveInstance(args.Instance, instance) {
+      return nil
+    }
     px.instances[args.Instance] = instance
     reply.Proposal = args.Proposal
     reply.OK = true
@@ -251,15 +782,22 @@ func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
   px.mu.Lock()
   defer px.mu.Unlock()
   
+  //a decision is final whatever we have promised since,
+  //e.g. to a stable leader that started after it. it is
+  //kept apart from (n_a, v_a), which a late accept from an
+  //older round may still change, and once made it never
+  //changes, whatever a later Decided says
   instance := px.GetPaxosState(args.Instance)
-  if args.Proposal >= instance.highestResponded {
-    instance.value = args.Value
-    instance.agreed = true
-    px.instances[args.Instance] = instance
-    reply.OK = true
-  } else {
-    reply.OK = false
+  reply.OK = true
+  if instance.agreed {
+    return nil
   }
+  instance.decided = args.Value
+  instance.agreed = true
+  px.saveInstance(args.Instance, instance)
+  px.instances[args.Instance] = instance
+  px.learnConfig(args.Instance, args.Value)
+  px.notify(args.Instance)
   
   return nil
 }
@@ -334,8 +872,12 @@ func (px *Paxos) Done(seq int) {
   defer px.mu.Unlock()
 
   //update my done map
-  me := px.peers[px.me]
-  px.maxPeerDones[me] = int(math.Max(float64(seq), float64(px.maxPeerDones[me])))
+  me := px.self
+  if seq > px.doneOf(me) {
+    px.maxPeerDones[me] = seq
+    px.saveDone(me, seq)
+  }
+  px.dropWaiters(px.Min())
 
   //garbage collecting
   // min := px.Min()
@@ -352,6 +894,9 @@ func (px *Paxos) Done(seq int) {
 // this peer.
 //
 func (px *Paxos) Max() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
   maxSeq := -1
   for inst := range(px.instances){
     maxSeq = int(math.Max(float64(maxSeq), float64(inst)))
@@ -389,12 +934,16 @@ func (px *Paxos) Max() int {
 // life, it will need to catch up on instances that it
 // missed -- the other peers therefor cannot forget these
 // instances.
+//
+// After a membership change, *all* means the peers of the
+// newest configuration this peer knows of; peers that have
+// been removed no longer hold back Min().
 // 
 func (px *Paxos) Min() int {
-  me := px.peers[px.me]
-  minSeq := px.maxPeerDones[me]
-  for _, peerMin := range(px.maxPeerDones){
-    minSeq = int(math.Min(float64(minSeq), float64(peerMin)))
+  me := px.self
+  minSeq := px.doneOf(me)
+  for _, peer := range(px.configs[len(px.configs) - 1].peers) {
+    minSeq = int(math.Min(float64(minSeq), float64(px.doneOf(peer))))
   }
   for instance := range(px.instances) {
     if minSeq >= instance {
@@ -418,7 +967,22 @@ func (px *Paxos) Status(seq int) (bool, interface{}) {
 
   if px.Min() <= seq {
     instance := px.GetPaxosState(seq)
-    return instance.agreed, instance.value
+    return instance.agreed, instance.decided
+  }
+  return false, nil
+}
+
+//
+// like Status(), but never creates state for seq, so asking
+// about an instance nobody has proposed leaves no trace in
+// Max() or in the log.
+//
+func (px *Paxos) Peek(seq int) (bool, interface{}) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  if instance, found := px.instances[seq]; found && px.Min() <= seq {
+    return instance.agreed, instance.decided
   }
   return false, nil
 }
@@ -442,9 +1006,30 @@ func (px *Paxos) Kill() {
 // are in peers[]. this servers port is peers[me].
 //
 func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+  return makePaxos(peers, me, rpcs, nil, 0)
+}
+
+//
+// like Make, but acceptor state is kept in dir and
+// reloaded from there, so a peer restarted with the
+// same dir remembers everything it promised and
+// accepted before it crashed. each peer needs its
+// own dir.
+//
+func MakeWithStorage(peers []string, me int, rpcs *rpc.Server, dir string) *Paxos {
+  storage, err := MakeFileStorage(dir)
+  if err != nil {
+    log.Fatal("storage error: ", err)
+  }
+  return makePaxos(peers, me, rpcs, storage, 0)
+}
+
+func makePaxos(peers []string, me int, rpcs *rpc.Server, storage Storage, first int) *Paxos {
   px := &Paxos{}
   px.peers = peers
   px.me = me
+  px.self = peers[me]
+  px.configs = []config{config{first, peers}}
 
 
   // Your initialization code here.
@@ -454,6 +1039,33 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
     px.maxPeerDones[peer] = -1
   }
 
+  px.promised = -1
+  px.ballot = -1
+  px.waiters = map[int][]chan bool{}
+  px.window = 10
+  px.proposing = map[int]bool{}
+  px.slotFree = sync.NewCond(&px.mu)
+  px.backoff = DefaultBackoff()
+  px.metrics.RoundsPerDecision = map[int]int{}
+
+  // reload state before answering any RPCs.
+  px.storage = storage
+  if px.storage != nil {
+    instances, dones, promise, err := px.storage.Load()
+    if err != nil {
+      log.Fatal("storage error: ", err)
+    }
+    px.instances = instances
+    for peer, done := range(dones) {
+      px.maxPeerDones[peer] = done
+    }
+    px.promisedFrom = promise.From
+    px.promised = promise.Proposal
+  }
+
+  // fill in decisions we missed.
+  go px.catchUp()
+
   if rpcs != nil {
     // caller will create socket &c
     rpcs.Register(px)
@@ -0,0 +1,289 @@
+package paxos
+
+//
+// write-ahead storage for acceptor state, so that a
+// peer can crash, restart, and still keep the promises
+// it made before the crash.
+//
+// every change to an instance's n_p, n_a, v_a or decided
+// flag, and every change to a peer's Done() value, is
+// appended to a log and fsync()ed before the RPC reply
+// that depends on it is sent.
+//
+// values handed to Start() travel through encoding/gob,
+// so the application must gob.Register() any concrete
+// types it proposes, just as it already does for RPC.
+//
+
+import "os"
+import "io"
+import "bytes"
+import "encoding/gob"
+import "encoding/binary"
+import "path/filepath"
+import "sync"
+
+type Storage interface {
+  // durably record the acceptor state for instance seq.
+  SaveInstance(seq int, instance Instance) error
+  // durably record the highest Done() value heard from peer.
+  SaveDone(peer string, done int) error
+  // durably record a promise made to a stable leader.
+  SavePromise(promise Promise) error
+  // rewrite the stored state to contain only what is passed in,
+  // so that forgotten instances stop taking up space.
+  Compact(instances map[int]Instance, dones map[string]int, promise Promise) error
+  // return everything saved so far.
+  Load() (map[int]Instance, map[string]int, Promise, error)
+  Close() error
+}
+
+const (
+  recordInstance = iota
+  recordDone
+  recordPromise
+)
+
+// rewrite the log once this many records have been
+// appended since the last rewrite.
+const compactThreshold = 1000
+
+// one entry in the log. Instance's fields are unexported,
+// so they are copied here for gob.
+type logRecord struct {
+  Kind int
+  Seq int
+  HighestAccepted int
+  HighestResponded int
+  Agreed bool
+  Value interface{}
+  Decided interface{}
+  Peer string
+  Done int
+}
+
+//
+// FileStorage keeps the log in a single file in dir.
+// each record is a 4-byte big-endian length followed by
+// a gob encoding of a logRecord.
+//
+type FileStorage struct {
+  mu sync.Mutex
+  dir string
+  f *os.File
+  appended int // records appended since the last rewrite
+}
+
+func MakeFileStorage(dir string) (*FileStorage, error) {
+  if err := os.MkdirAll(dir, 0777); err != nil {
+    return nil, err
+  }
+  fs := &FileStorage{}
+  fs.dir = dir
+  f, err := os.OpenFile(fs.logPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+  if err != nil {
+    return nil, err
+  }
+  fs.f = f
+  return fs, nil
+}
+
+func (fs *FileStorage) logPath() string {
+  return filepath.Join(fs.dir, "paxos.log")
+}
+
+func encodeRecord(rec *logRecord) ([]byte, error) {
+  var body bytes.Buffer
+  if err := gob.NewEncoder(&body).Encode(rec); err != nil {
+    return nil, err
+  }
+  buf := make([]byte, 4 + body.Len())
+  binary.BigEndian.PutUint32(buf, uint32(body.Len()))
+  copy(buf[4:], body.Bytes())
+  return buf, nil
+}
+
+// append one record and wait for it to reach the disk.
+func (fs *FileStorage) append(rec *logRecord) error {
+  buf, err := encodeRecord(rec)
+  if err != nil {
+    return err
+  }
+
+  fs.mu.Lock()
+  defer fs.mu.Unlock()
+
+  if _, err := fs.f.Write(buf); err != nil {
+    return err
+  }
+  fs.appended++
+  return fs.f.Sync()
+}
+
+func instanceRecord(seq int, instance Instance) *logRecord {
+  rec := &logRecord{}
+  rec.Kind = recordInstance
+  rec.Seq = seq
+  rec.HighestAccepted = instance.highestAccepted
+  rec.HighestResponded = instance.highestResponded
+  rec.Agreed = instance.agreed
+  rec.Value = instance.value
+  rec.Decided = instance.decided
+  return rec
+}
+
+func doneRecord(peer string, done int) *logRecord {
+  rec := &logRecord{}
+  rec.Kind = recordDone
+  rec.Peer = peer
+  rec.Done = done
+  return rec
+}
+
+func promiseRecord(promise Promise) *logRecord {
+  rec := &logRecord{}
+  rec.Kind = recordPromise
+  rec.Seq = promise.From
+  rec.HighestResponded = promise.Proposal
+  return rec
+}
+
+func (fs *FileStorage) SaveInstance(seq int, instance Instance) error {
+  return fs.append(instanceRecord(seq, instance))
+}
+
+func (fs *FileStorage) SaveDone(peer string, done int) error {
+  return fs.append(doneRecord(peer, done))
+}
+
+func (fs *FileStorage) SavePromise(promise Promise) error {
+  return fs.append(promiseRecord(promise))
+}
+
+//
+// write a fresh log next to the old one and rename it
+// into place, so that a crash part way through leaves
+// either the old log or the new one.
+//
+func (fs *FileStorage) Compact(instances map[int]Instance, dones map[string]int, promise Promise) error {
+  fs.mu.Lock()
+  defer fs.mu.Unlock()
+
+  if fs.appended < compactThreshold {
+    return nil
+  }
+
+  tmp := fs.logPath() + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0666)
+  if err != nil {
+    return err
+  }
+
+  var out bytes.Buffer
+  for seq, instance := range instances {
+    buf, err := encodeRecord(instanceRecord(seq, instance))
+    if err != nil {
+      f.Close()
+      return err
+    }
+    out.Write(buf)
+  }
+  for peer, done := range dones {
+    buf, err := encodeRecord(doneRecord(peer, done))
+    if err != nil {
+      f.Close()
+      return err
+    }
+    out.Write(buf)
+  }
+  buf, err := encodeRecord(promiseRecord(promise))
+  if err != nil {
+    f.Close()
+    return err
+  }
+  out.Write(buf)
+
+  if _, err := f.Write(out.Bytes()); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Sync(); err != nil {
+    f.Close()
+    return err
+  }
+  if err := os.Rename(tmp, fs.logPath()); err != nil {
+    f.Close()
+    return err
+  }
+  if d, err := os.Open(fs.dir); err == nil {
+    d.Sync()
+    d.Close()
+  }
+
+  fs.f.Close()
+  fs.f = f
+  fs.appended = 0
+  return nil
+}
+
+//
+// replay the log. later records for the same instance
+// or peer replace earlier ones. a record cut short by a
+// crash in the middle of a write is discarded, along with
+// anything after it.
+//
+func (fs *FileStorage) Load() (map[int]Instance, map[string]int, Promise, error) {
+  fs.mu.Lock()
+  defer fs.mu.Unlock()
+
+  instances := map[int]Instance{}
+  dones := map[string]int{}
+  promise := Promise{0, -1}
+
+  if _, err := fs.f.Seek(0, io.SeekStart); err != nil {
+    return nil, nil, promise, err
+  }
+
+  var good int64 = 0
+  header := make([]byte, 4)
+  for {
+    if _, err := io.ReadFull(fs.f, header); err != nil {
+      break
+    }
+    body := make([]byte, binary.BigEndian.Uint32(header))
+    if _, err := io.ReadFull(fs.f, body); err != nil {
+      break
+    }
+    var rec logRecord
+    if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&rec); err != nil {
+      break
+    }
+    good += int64(4 + len(body))
+
+    switch rec.Kind {
+    case recordInstance:
+      instance := MakeInstance()
+      instance.highestAccepted = rec.HighestAccepted
+      instance.highestResponded = rec.HighestResponded
+      instance.agreed = rec.Agreed
+      instance.value = rec.Value
+      instance.decided = rec.Decided
+      instances[rec.Seq] = instance
+    case recordDone:
+      dones[rec.Peer] = rec.Done
+    case recordPromise:
+      promise = Promise{rec.Seq, rec.HighestResponded}
+    }
+  }
+
+  if err := fs.f.Truncate(good); err != nil {
+    return nil, nil, promise, err
+  }
+  return instances, dones, promise, nil
+}
+
+func (fs *FileStorage) Close() error {
+  fs.mu.Lock()
+  defer fs.mu.Unlock()
+  return fs.f.Close()
+}
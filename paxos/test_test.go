@@ -536,6 +536,53 @@ func TestMany(t *testing.T) {
   }
 
   fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Throughput with and without pipelining ...\n")
+
+  serial, serialPeak := throughput(t, "many-serial", 1)
+  pipelined, pipelinedPeak := throughput(t, "many-pipelined", 10)
+  fmt.Printf("  window 1: %.0f/s, window 10: %.0f/s\n", serial, pipelined)
+  // local RPCs are too cheap for the two rates to differ
+  // reliably, so check that the window is what bounds the
+  // burst: one instance at a time, or several.
+  if serialPeak != 1 {
+    t.Fatalf("window 1 had %v instances in flight at once", serialPeak)
+  }
+  if pipelinedPeak <= 1 || pipelinedPeak > 10 {
+    t.Fatalf("window 10 had %v instances in flight at once", pipelinedPeak)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// agreements per second when one peer starts a burst
+// of instances with the given pipelining window, and
+// the most instances that peer had in flight at once.
+//
+func throughput(t *testing.T, tag string, window int) (float64, int) {
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port(tag, i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+    pxa[i].SetWindow(window)
+  }
+
+  const ninst = 30
+  t0 := time.Now()
+  for seq := 0; seq < ninst; seq++ {
+    pxa[0].Start(seq, seq)
+  }
+  for seq := 0; seq < ninst; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+  return ninst / time.Since(t0).Seconds(), pxa[0].Metrics().MaxInFlight
 }
 
 //
@@ -576,6 +623,707 @@ func TestOld(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+//
+// peers made with MakeWithStorage remember decisions
+// and promises across a crash and restart.
+//
+func TestPersist(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Crash and restart with storage ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  var dirs []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("persist", i)
+    dirs[i] = port("persistdir", i)
+    os.RemoveAll(dirs[i])
+    defer os.RemoveAll(dirs[i])
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeWithStorage(pxh, i, nil, dirs[i])
+  }
+
+  const ninst = 5
+  for seq := 0; seq < ninst; seq++ {
+    pxa[0].Start(seq, seq * 10)
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  // everyone crashes and comes back.
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Kill()
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeWithStorage(pxh, i, nil, dirs[i])
+  }
+
+  for seq := 0; seq < ninst; seq++ {
+    for i := 0; i < npaxos; i++ {
+      decided, v := pxa[i].Status(seq)
+      if decided == false || v != seq * 10 {
+        t.Fatalf("peer %v forgot seq %v across restart; decided=%v v=%v",
+          i, seq, decided, v)
+      }
+    }
+  }
+
+  // a prepare no higher than one already promised
+  // must still be rejected.
+  args := &PrepareArgs{0, 0, -1, pxh[0]}
+  var reply PrepareReply
+  pxa[2].Prepare(args, &reply)
+  if reply.OK {
+    t.Fatalf("restarted peer broke its promise for seq 0")
+  }
+
+  pxa[1].Start(ninst, "after")
+  waitn(t, pxa, ninst, npaxos)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// in stable-leader mode, a peer that keeps proposing
+// only needs phase 2 after its first agreement, and
+// pre-empting it must not break agreement.
+//
+func TestStableLeader(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Stable leader skips phase 1 ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("leader", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+    pxa[i].SetLeaderMode(true)
+  }
+
+  pxa[0].Start(0, "x")
+  waitn(t, pxa, 0, npaxos)
+  time.Sleep(1 * time.Second)
+
+  total0 := 0
+  for j := 0; j < npaxos; j++ {
+    total0 += pxa[j].rpcCount
+  }
+
+  const ninst = 10
+  for seq := 1; seq <= ninst; seq++ {
+    pxa[0].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos)
+  }
+  time.Sleep(1 * time.Second)
+
+  total1 := 0
+  for j := 0; j < npaxos; j++ {
+    total1 += pxa[j].rpcCount
+  }
+  total1 -= total0
+
+  // per agreement:
+  // 2 accepts
+  // 2 decides
+  expected1 := ninst * (npaxos - 1) * 2
+  if total1 > expected1 {
+    t.Fatalf("too many RPCs for a stable leader; %v instances, got %v, expected %v",
+      ninst, total1, expected1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pre-empting a stable leader ...\n")
+
+  for seq := ninst + 1; seq <= 2 * ninst; seq++ {
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, (seq * 10) + i)
+    }
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Stable leader never decides an instance twice ...\n")
+
+  // pxa[0] takes the lead again, then proposes other
+  // values for instances it has already decided, or is
+  // deciding at the same time.
+  base := 2 * ninst + 1
+  pxa[0].Propose(base, "x")
+  pxa[0].Propose(base + 1, "a")
+  pxa[0].Propose(base + 1, "b")
+  waitn(t, pxa, base + 1, npaxos)
+  for i := 0; i < npaxos; i++ {
+    if _, v := pxa[i].Status(base + 1); v != "a" {
+      t.Fatalf("peer %v decided %v for an instance first decided as a", i, v)
+    }
+  }
+
+  for seq := base + 2; seq < base + 7; seq++ {
+    for j := 0; j < 4; j++ {
+      go pxa[0].Propose(seq, (seq * 10) + j)
+    }
+  }
+  for seq := base + 2; seq < base + 7; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+  time.Sleep(500 * time.Millisecond)
+  for seq := base + 1; seq < base + 7; seq++ {
+    // fails if any two peers now disagree
+    ndecided(t, pxa, seq)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// proposal numbers are owned by exactly one peer, and
+// dueling proposers on a single instance never get two
+// different values accepted under the same number.
+//
+func TestDuelingProposers(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Proposal numbers are unique per peer ...\n")
+
+  const npaxos = 5
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("duel", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  owner := map[int]int{}
+  for n := -1; n < 100; n++ {
+    for i := 0; i < npaxos; i++ {
+      p := pxa[i].proposalAbove(n, pxh)
+      if p <= n || p > n + npaxos {
+        t.Fatalf("peer %v chose %v after %v", i, p, n)
+      }
+      if o, found := owner[p]; found && o != i {
+        t.Fatalf("peers %v and %v both chose proposal %v", o, i, p)
+      }
+      owner[p] = i
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Dueling proposers on one instance ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].unreliable = true
+  }
+
+  // run a duel on each of instances from..from+ninst-1,
+  // checking that no number is accepted with two values.
+  const ninst = 5
+  duel := func(from int) {
+    for seq := from; seq < from + ninst; seq++ {
+      done := false
+      // n_a -> v_a as seen on any acceptor
+      accepted := map[int]interface{}{}
+      ch := make(chan bool)
+      go func() {
+        defer func() { ch <- true }()
+        for done == false {
+          for i := 0; i < npaxos; i++ {
+            pxa[i].mu.Lock()
+            inst, found := pxa[i].instances[seq]
+            pxa[i].mu.Unlock()
+            if found && inst.highestAccepted >= 0 {
+              if v, ok := accepted[inst.highestAccepted]; ok && v != inst.value {
+                t.Errorf("seq %v: proposal %v accepted with %v and %v",
+                  seq, inst.highestAccepted, v, inst.value)
+              }
+              accepted[inst.highestAccepted] = inst.value
+            }
+          }
+          time.Sleep(time.Millisecond)
+        }
+      }()
+
+      for i := 0; i < npaxos; i++ {
+        for j := 0; j < 3; j++ {
+          go pxa[i].Propose(seq, (seq * 100) + (i * 10) + j)
+        }
+      }
+      waitn(t, pxa, seq, npaxos)
+      // proposing again once decided must change nothing.
+      for i := 0; i < npaxos; i++ {
+        pxa[i].Propose(seq, "again")
+      }
+      done = true
+      <- ch
+    }
+  }
+  duel(0)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Dueling stable leaders on one instance ...\n")
+
+  // a leader skips phase 1, so its own concurrent
+  // proposals share one number.
+  for i := 0; i < npaxos; i++ {
+    pxa[i].SetLeaderMode(true)
+  }
+  duel(ninst)
+  for i := 0; i < npaxos; i++ {
+    pxa[i].SetLeaderMode(false)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Late accept after a decision ...\n")
+
+  _, v0 := pxa[0].Status(0)
+  args := &AcceptArgs{0, pxa[1].proposalAbove(1000, pxh), "late", -1, pxh[1]}
+  var reply AcceptReply
+  pxa[0].Accept(args, &reply)
+  if !reply.OK {
+    t.Fatalf("higher accept after a decision was refused")
+  }
+  if _, v := pxa[0].Status(0); v != v0 {
+    t.Fatalf("late accept changed decided value %v to %v", v0, v)
+  }
+  var dreply DecidedReply
+  pxa[0].Decided(&DecidedArgs{0, args.Proposal, "late"}, &dreply)
+  if _, v := pxa[0].Status(0); v != v0 {
+    t.Fatalf("second Decided changed decided value %v to %v", v0, v)
+  }
+  pxa[0].mu.Lock()
+  inst := pxa[0].instances[0]
+  pxa[0].mu.Unlock()
+  if inst.highestAccepted != args.Proposal || inst.value != "late" {
+    t.Fatalf("accepted (%v, %v), wanted (%v, late)",
+      inst.highestAccepted, inst.value, args.Proposal)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestBackoff(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Backoff delays stay within bounds ...\n")
+
+  b := Backoff{10 * time.Millisecond, 80 * time.Millisecond, 0}
+  for rounds := 1; rounds < 10; rounds++ {
+    for i := 0; i < 20; i++ {
+      d := b.delay(rounds, false)
+      if d < b.Min / 2 || d > b.Max {
+        t.Fatalf("delay %v after %v rounds out of bounds", d, rounds)
+      }
+    }
+    // contended delays stay random, so duelists drift apart.
+    base := b.Min << uint(rounds - 1)
+    if base > b.Max {
+      base = b.Max
+    }
+    seen := map[time.Duration]bool{}
+    for i := 0; i < 20; i++ {
+      d := b.delay(rounds, true)
+      if d < base || d >= 2 * base {
+        t.Fatalf("contended delay %v after %v rounds not in [%v, %v)",
+          d, rounds, base, 2 * base)
+      }
+      seen[d] = true
+    }
+    if len(seen) < 2 {
+      t.Fatalf("contended delays after %v rounds are all the same", rounds)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Rounds per decision are counted ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("backoff", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  const ninst = 5
+  for seq := 0; seq < ninst; seq++ {
+    pxa[0].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos)
+  }
+  time.Sleep(100 * time.Millisecond)
+
+  m := pxa[0].Metrics()
+  if m.Decisions != ninst || m.RoundsPerDecision[1] != ninst {
+    t.Fatalf("uncontended proposals: wanted %v one-round decisions, got %v",
+      ninst, m.RoundsPerDecision)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Proposer gives up after its retry budget ...\n")
+
+  pxa[1].Kill()
+  pxa[2].Kill()
+  pxa[0].SetBackoff(Backoff{time.Millisecond, 5 * time.Millisecond, 3})
+  pxa[0].Start(ninst, "lonely")
+
+  gaveup := false
+  for iters := 0; iters < 50 && !gaveup; iters++ {
+    time.Sleep(20 * time.Millisecond)
+    m = pxa[0].Metrics()
+    gaveup = m.GaveUp == 1
+  }
+  if !gaveup {
+    t.Fatalf("proposer without a majority never gave up")
+  }
+  if m.Rounds != ninst + 3 {
+    t.Fatalf("wanted %v rounds in total, got %v", ninst + 3, m.Rounds)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestBatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Batched values share instances ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("batch", i)
+  }
+  var ba []*Batcher = make([]*Batcher, npaxos)
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+    ba[i] = MakeBatcher(pxa[i], 10, 20 * time.Millisecond)
+  }
+
+  const nvalues = 30
+  for j := 0; j < nvalues; j++ {
+    for i := 0; i < npaxos; i++ {
+      go ba[i].Start((i * 1000) + j)
+    }
+  }
+
+  // every value shows up in exactly one instance, and
+  // every peer sees the same ordered list.
+  seen := map[interface{}]int{}
+  seq := 0
+  for iters := 0; iters < 200 && len(seen) < npaxos * nvalues; iters++ {
+    decided, vs := ba[0].Status(seq)
+    if decided == false {
+      time.Sleep(50 * time.Millisecond)
+      continue
+    }
+    for i := 1; i < npaxos; i++ {
+      decided1, vs1 := ba[i].Status(seq)
+      for iters1 := 0; iters1 < 100 && decided1 == false; iters1++ {
+        time.Sleep(20 * time.Millisecond)
+        decided1, vs1 = ba[i].Status(seq)
+      }
+      if len(vs1) != len(vs) {
+        t.Fatalf("seq %v: peer %v has %v values, peer 0 has %v", seq, i, len(vs1), len(vs))
+      }
+      for k := 0; k < len(vs); k++ {
+        if vs1[k] != vs[k] {
+          t.Fatalf("seq %v: peers disagree on value %v", seq, k)
+        }
+      }
+    }
+    for _, v := range vs {
+      if s, found := seen[v]; found {
+        t.Fatalf("value %v decided in both seq %v and seq %v", v, s, seq)
+      }
+      seen[v] = seq
+    }
+    seq++
+  }
+  if len(seen) != npaxos * nvalues {
+    t.Fatalf("only %v of %v values were decided", len(seen), npaxos * nvalues)
+  }
+  if seq >= npaxos * nvalues {
+    t.Fatalf("%v values took %v instances; no batching", len(seen), seq)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestNotify(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: WaitDecided wakes up on decision ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("notify", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  decided, _ := pxa[1].WaitDecided(0, 50 * time.Millisecond)
+  if decided {
+    t.Fatalf("WaitDecided reported an instance nobody started")
+  }
+  pxa[1].mu.Lock()
+  nwaiters := len(pxa[1].waiters)
+  pxa[1].mu.Unlock()
+  if nwaiters != 0 {
+    t.Fatalf("WaitDecided left %v waiters behind after timing out", nwaiters)
+  }
+
+  go func() {
+    time.Sleep(100 * time.Millisecond)
+    pxa[0].Start(0, "hello")
+  }()
+  t0 := time.Now()
+  decided, v := pxa[1].WaitDecided(0, 10 * time.Second)
+  if decided == false || v != "hello" {
+    t.Fatalf("WaitDecided returned %v %v", decided, v)
+  }
+  if time.Since(t0) > 2 * time.Second {
+    t.Fatalf("WaitDecided took %v", time.Since(t0))
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Subscribe delivers decisions in order ...\n")
+
+  ch, cancel := pxa[2].Subscribe(0)
+  defer cancel()
+
+  const ninst = 10
+  for seq := ninst; seq > 0; seq-- {
+    pxa[seq % npaxos].Start(seq, seq * 10)
+  }
+  for seq := 0; seq <= ninst; seq++ {
+    select {
+    case d := <-ch:
+      if d.Seq != seq {
+        t.Fatalf("Subscribe delivered seq %v, expected %v", d.Seq, seq)
+      }
+      if seq > 0 && d.Value != seq * 10 {
+        t.Fatalf("Subscribe delivered %v for seq %v", d.Value, seq)
+      }
+    case <-time.After(10 * time.Second):
+      t.Fatalf("Subscribe never delivered seq %v", seq)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestCatchUp(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Lagging peer fetches missed decisions ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("catchup", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  // peer 2 stops hearing anything, but can still send.
+  os.Remove(pxh[2])
+
+  const ninst = 5
+  for seq := 0; seq < ninst; seq++ {
+    pxa[0].Start(seq, seq * 10)
+    waitn(t, pxa, seq, npaxos - 1)
+  }
+  if ndecided(t, pxa, 0) != npaxos - 1 {
+    t.Fatalf("a deaf peer heard about a decision")
+  }
+
+  if pxa[2].Fetch(0) == false {
+    t.Fatalf("Fetch() could not find a decided instance")
+  }
+  waitn(t, pxa, 0, npaxos)
+
+  // once peer 2 knows of a later instance, the holes
+  // before it get filled in the background.
+  pxa[2].Start(ninst, "late")
+  waitn(t, pxa, ninst, npaxos - 1)
+  for seq := 1; seq < ninst; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: ReadIndex ignores instances nobody proposed ...\n")
+
+  for i := 0; i < npaxos; i++ {
+    pxa[i].Status(ninst + 10)
+  }
+  if m := pxa[1].MaxAccepted(); m != ninst {
+    t.Fatalf("MaxAccepted() = %v, expected %v", m, ninst)
+  }
+  if seq, ok := pxa[0].ReadIndex(); !ok || seq != ninst {
+    t.Fatalf("ReadIndex() = %v %v, expected %v true", seq, ok, ninst)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// like waitn, for logs holding values that == can't compare.
+//
+func waitsame(t *testing.T, pxa []*Paxos, seq int, wanted int) {
+  for iters := 0; iters < 100; iters++ {
+    count := 0
+    var v string
+    for i := 0; i < len(pxa); i++ {
+      if pxa[i] == nil {
+        continue
+      }
+      if decided, v1 := pxa[i].Status(seq); decided {
+        if count > 0 && v != fmt.Sprint(v1) {
+          t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v",
+            seq, i, v, v1)
+        }
+        count++
+        v = fmt.Sprint(v1)
+      }
+    }
+    if count >= wanted {
+      return
+    }
+    time.Sleep(50 * time.Millisecond)
+  }
+  t.Fatalf("too few decided; seq=%v wanted=%v", seq, wanted)
+}
+
+func TestReconfig(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  const alpha = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("reconfig", i)
+  }
+  for i := 0; i < 3; i++ {
+    pxa[i] = Make(pxh[:3], i, nil)
+    pxa[i].SetReconfigWindow(alpha)
+  }
+
+  // keep proposing from peer 1 while the peer set changes.
+  load := func(stop chan bool, done chan bool) {
+    for {
+      select {
+      case <-stop:
+        done <- true
+        return
+      default:
+      }
+      seq := pxa[1].Max() + 1
+      pxa[1].Start(seq, seq * 10)
+      time.Sleep(20 * time.Millisecond)
+    }
+  }
+
+  fmt.Printf("Test: Add a peer under load ...\n")
+
+  for seq := 0; seq < 5; seq++ {
+    pxa[seq % 3].Start(seq, seq * 10)
+    waitsame(t, pxa, seq, 3)
+  }
+
+  stop := make(chan bool)
+  done := make(chan bool)
+  go load(stop, done)
+
+  first := pxa[0].ProposeConfig(pxh[:4])
+  if first < 5 + alpha {
+    t.Fatalf("ProposeConfig() returned %v", first)
+  }
+  pxa[3] = MakeFrom(pxh[:4], 3, nil, first)
+  pxa[3].SetReconfigWindow(alpha)
+
+  for seq := first; seq < first + 5; seq++ {
+    pxa[3].Start(seq, "added")
+  }
+  for seq := first; seq < first + 5; seq++ {
+    waitsame(t, pxa, seq, 4)
+  }
+  for i := 0; i < npaxos; i++ {
+    if peers := pxa[i].PeersFor(first); len(peers) != 4 {
+      t.Fatalf("peer %v thinks %v decide instance %v", i, peers, first)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Remove a peer under load ...\n")
+
+  smaller := []string{pxh[0], pxh[1], pxh[3]}
+  second := pxa[3].ProposeConfig(smaller)
+  if second <= first {
+    t.Fatalf("ProposeConfig() returned %v", second)
+  }
+  stop <- true
+  <-done
+
+  // every instance so far was decided the same way everywhere.
+  seq := pxa[1].Max() + 1
+  for s := 0; s < seq; s++ {
+    waitsame(t, pxa, s, 3)
+  }
+  if seq < second {
+    seq = second
+  }
+
+  // peers 0 and 1 are a majority of the new set, but
+  // not of the old one.
+  pxa[2].Kill()
+  pxa[3].Kill()
+
+  pxa[0].Start(seq, "removed")
+  waitsame(t, pxa[:2], seq, 2)
+
+  fmt.Printf("  ... Passed\n")
+}
+
 //
 // many agreements, with unreliable RPC
 //
@@ -772,7 +1520,25 @@ func TestLots(t *testing.T) {
 
   fmt.Printf("Test: Many requests, changing partitions ...\n")
 
-  tag := "lots"
+  lots(t, "lots", 10)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLotsSerial(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Many requests, changing partitions, no pipelining ...\n")
+
+  lots(t, "lotsserial", 1)
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// the body of TestLots, with the given pipelining window.
+//
+func lots(t *testing.T, tag string, window int) {
   const npaxos = 5
   var pxa []*Paxos = make([]*Paxos, npaxos)
   defer cleanup(pxa)
@@ -789,6 +1555,7 @@ func TestLots(t *testing.T) {
     }
     pxa[i] = Make(pxh, i, nil)
     pxa[i].unreliable = true
+    pxa[i].SetWindow(window)
   }
   defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
@@ -870,5 +1637,22 @@ func TestLots(t *testing.T) {
     waitmajority(t, pxa, i)
   }
 
-  fmt.Printf("  ... Passed\n")
-}
\ No newline at end of file
+  fmt.Printf("  window %v: %v instances in 20 seconds\n", window, seq)
+  if seq < 10 {
+    t.Fatalf("only %v instances started in 20 seconds", seq)
+  }
+  peak := 0
+  for i := 0; i < npaxos; i++ {
+    m := pxa[i].Metrics()
+    if m.MaxInFlight > window {
+      t.Fatalf("peer %v had %v instances in flight with window %v",
+        i, m.MaxInFlight, window)
+    }
+    if m.MaxInFlight > peak {
+      peak = m.MaxInFlight
+    }
+  }
+  if window > 1 && peak <= 1 {
+    t.Fatalf("window %v never had more than one instance in flight", window)
+  }
+}
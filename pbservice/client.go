@@ -2,6 +2,7 @@ package pbservice
 
 import "viewservice"
 import "net/rpc"
+import "context"
 // import "fmt"
 import "time"
 
@@ -50,6 +51,38 @@ func call(srv string, rpcname string,
   return false
 }
 
+//
+// call() that gives up when ctx ends. a primary that stopped
+// answering mid-call, e.g. one the viewservice has since
+// replaced, may hold the RPC open for as long as the
+// connection lasts; the call is not re-sent to its successor,
+// since the old primary may still carry it out.
+//
+func callContext(ctx context.Context, srv string, rpcname string,
+                 args interface{}, reply interface{}) bool {
+  done := make(chan bool, 1)
+  go func() {
+    done <- call(srv, rpcname, args, reply)
+  }()
+  select {
+  case ok := <-done:
+    return ok
+  case <-ctx.Done():
+    return false
+  }
+}
+
+//
+// ErrTimeout if ctx's deadline passed with no primary
+// answering, e.g. while the viewservice had none to offer.
+//
+func ctxErr(ctx context.Context) error {
+  if ctx.Err() == context.DeadlineExceeded {
+    return ErrTimeout
+  }
+  return ctx.Err()
+}
+
 //
 // fetch a key's value from the current primary;
 // if they key has never been set, return "".
@@ -58,23 +91,32 @@ func call(srv string, rpcname string,
 // says the key doesn't exist (has never been Put().
 //
 func (ck *Clerk) Get(key string) string {
+  value, _ := ck.GetContext(context.Background(), key)
+  return value
+}
+
+//
+// like Get, but gives up when ctx ends, returning ErrTimeout
+// if its deadline passed. returns ErrNoKey if the key has
+// never been Put().
+//
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, error) {
   args := &GetArgs{}
   args.Key = key
-  var reply GetReply
-  ok := false
-  for !ok {
-    ok = call(ck.view.Primary, "PBServer.Get", args, &reply)
-    if reply.Err == ErrWrongServer || !ok {
+  for ctx.Err() == nil {
+    var reply GetReply
+    ok := callContext(ctx, ck.view.Primary, "PBServer.Get", args, &reply)
+    if ok && reply.Err == OK {
+      return reply.Value, nil
+    }
+    if ok && reply.Err == ErrNoKey {
+      return "", ErrNoKey
+    }
+    if ctx.Err() == nil {
       ck.CheckPrimary()
-      // fmt.Println("checking for new primary",ck.view.Primary, ck.view.Backup)
     }
-    time.Sleep(viewservice.PingInterval)
-    
   }
-  if reply.Err == OK {
-    return reply.Value
-  }
-  return ""
+  return "", ctxErr(ctx)
 }
 
 //
@@ -82,18 +124,28 @@ func (ck *Clerk) Get(key string) string {
 // must keep trying until it succeeds.
 //
 func (ck *Clerk) Put(key string, value string) {
+  ck.PutContext(context.Background(), key, value)
+}
+
+//
+// like Put, but gives up when ctx ends. a Put given up
+// on may still happen later.
+//
+func (ck *Clerk) PutContext(ctx context.Context, key string, value string) error {
   args := &PutArgs{}
   args.Key = key
   args.Value = value
-  var reply PutReply
-  ok := false
-  for !ok {
-    ok = call(ck.view.Primary, "PBServer.Put", args, &reply)
-    if reply.Err == ErrWrongServer || !ok {
+  for ctx.Err() == nil {
+    var reply PutReply
+    ok := callContext(ctx, ck.view.Primary, "PBServer.Put", args, &reply)
+    if ok && reply.Err == OK {
+      return nil
+    }
+    if ctx.Err() == nil {
       ck.CheckPrimary()
     }
-    time.Sleep(viewservice.PingInterval)
   }
+  return ctxErr(ctx)
 }
 
 func (ck *Clerk) CheckPrimary() {
@@ -2,11 +2,23 @@ package pbservice
 
 const (
   OK = "OK"
-  ErrNoKey = "ErrNoKey"
-  ErrWrongServer = "ErrWrongServer"
+)
+
+const (
+  ErrNoKey Err = "ErrNoKey"
+  ErrWrongServer Err = "ErrWrongServer"
+  ErrTimeout Err = "ErrTimeout" // no primary answered before the deadline
 )
 type Err string
 
+//
+// lets GetContext return ErrNoKey as an error. ErrWrongServer
+// never does; the Clerk retries with the next primary.
+//
+func (e Err) Error() string {
+  return string(e)
+}
+
 type PutArgs struct {
   Key string
   Value string
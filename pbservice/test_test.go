@@ -11,6 +11,7 @@ import "runtime"
 import "math/rand"
 import "os"
 import "strconv"
+import "context"
 
 func check(ck *Clerk, key string, value string) {
   v := ck.Get(key)
@@ -853,3 +854,91 @@ func TestPartition2(t *testing.T) {
   s3.kill()
   vs.Kill()
 }
+
+func TestContext(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  tag := "context"
+  vshost := port(tag+"v", 1)
+  vs := viewservice.StartServer(vshost)
+  time.Sleep(time.Second)
+  vck := viewservice.MakeClerk("", vshost)
+
+  s1 := StartServer(vshost, port(tag, 1))
+
+  deadtime := viewservice.PingInterval * viewservice.DeadPings
+  time.Sleep(deadtime * 2)
+  if vck.Primary() != s1.me {
+    t.Fatal("first primary never formed view")
+  }
+
+  s2 := StartServer(vshost, port(tag, 2))
+  time.Sleep(deadtime * 2)
+  v, _ := vck.Get()
+  if v.Primary != s1.me || v.Backup != s2.me {
+    t.Fatal("backup never joined the view")
+  }
+
+  ck := MakeClerk(vshost, "")
+  ctx := context.Background()
+  if err := ck.PutContext(ctx, "a", "x"); err != nil {
+    t.Fatalf("PutContext: %v", err)
+  }
+
+  fmt.Printf("Test: Context deadline bounds a call the primary failed over on ...\n")
+
+  // s1 takes the Put but never answers, and stops
+  // pinging, so the viewservice promotes s2 while
+  // the call is still in flight.
+  s1.mu.Lock()
+
+  dctx, cancel := context.WithTimeout(ctx, 3 * deadtime)
+  defer cancel()
+  t0 := time.Now()
+  err := ck.PutContext(dctx, "a", "y")
+  d := time.Since(t0)
+  if err != ErrTimeout {
+    t.Fatalf("PutContext stuck on the old primary: %v, want ErrTimeout", err)
+  }
+  if d > 3 * deadtime + time.Second {
+    t.Fatalf("PutContext returned %v after its deadline", d)
+  }
+  if vck.Primary() != s2.me {
+    t.Fatalf("s2 never became primary")
+  }
+
+  // the Clerk finds the new primary once s1 is gone.
+  s1.kill()
+  s1.mu.Unlock()
+  if err := ck.PutContext(ctx, "a", "z"); err != nil {
+    t.Fatalf("PutContext after the failover: %v", err)
+  }
+  if v, err := ck.GetContext(ctx, "a"); err != nil || v != "z" {
+    t.Fatalf("GetContext from the new primary: %v %v, want z", v, err)
+  }
+  if _, err := ck.GetContext(ctx, "b"); err != ErrNoKey {
+    t.Fatalf("GetContext of a missing key: %v, want ErrNoKey", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Context deadline with no primary left ...\n")
+
+  // the viewservice can't promote anyone, and keeps
+  // naming the dead s2.
+  s2.kill()
+
+  dctx2, cancel2 := context.WithTimeout(ctx, 500 * time.Millisecond)
+  defer cancel2()
+  t0 = time.Now()
+  if err := ck.PutContext(dctx2, "a", "w"); err != ErrTimeout {
+    t.Fatalf("PutContext with no primary: %v, want ErrTimeout", err)
+  }
+  if d := time.Since(t0); d > 2 * time.Second {
+    t.Fatalf("PutContext returned %v after its deadline", d)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  vs.Kill()
+}
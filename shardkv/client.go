@@ -2,6 +2,7 @@ package shardkv
 
 import "shardmaster"
 import "net/rpc"
+import "context"
 import "time"
 import "sync"
 // import "fmt"
@@ -52,91 +53,175 @@ func call(srv string, rpcname string,
 }
 
 //
-// which shard is a key in?
-// please use this function,
-// and please do not change it.
+// which of nshards shards is a key in?
+// please use this function. keys must map to shards
+// modulo nshards, so that a shard split by the
+// shardmaster's Split() keeps each key's old owner.
 //
-func key2shard(key string) int {
+func key2shard(key string, nshards int) int {
   shard := 0
   if len(key) > 0 {
     shard = int(key[0])
   }
-  shard %= shardmaster.NShards
+  shard %= nshards
   return shard
 }
 
+//
+// call() that gives up when ctx ends, e.g. while a group
+// waits for a shard it is receiving. each server of the
+// group gets a new reply.
+//
+func callContext(ctx context.Context, srv string, rpcname string,
+                 args interface{}, reply interface{}) bool {
+  done := make(chan bool, 1)
+  go func() {
+    done <- call(srv, rpcname, args, reply)
+  }()
+  select {
+  case ok := <-done:
+    return ok
+  case <-ctx.Done():
+    return false
+  }
+}
+
+//
+// the error for a request given up on because ctx ended:
+// ErrWrongGroup if the last group we reached no longer
+// serves the key's shard, ErrTimeout if the deadline
+// passed, else ctx.Err().
+//
+func ctxErr(ctx context.Context, last Err) error {
+  if last == ErrWrongGroup {
+    return ErrWrongGroup
+  }
+  if ctx.Err() == context.DeadlineExceeded {
+    return ErrTimeout
+  }
+  return ctx.Err()
+}
+
+//
+// wait a little, then ask the master for a new configuration.
+// returns false if ctx ends first.
+//
+func (ck *Clerk) refresh(ctx context.Context) bool {
+  select {
+  case <-ctx.Done():
+    return false
+  case <-time.After(100 * time.Millisecond):
+  }
+  config, err := ck.sm.QueryContext(ctx, -1)
+  if err != nil {
+    return false
+  }
+  ck.config = config
+  return true
+}
+
 //
 // fetch the current value for a key.
 // returns "" if the key does not exist.
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
+  value, _ := ck.GetContext(context.Background(), key)
+  return value
+}
+
+//
+// like Get, but gives up when ctx ends; see ctxErr() for
+// the errors. returns ErrNoKey if the key does not exist.
+//
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, error) {
   ck.mu.Lock()
   defer ck.mu.Unlock()
 
-
-  // You'll have to modify Get().
-
+  var last Err
   for {
-    shard := key2shard(key)
-
-    gid := ck.config.Shards[shard]
-
-    servers, ok := ck.config.Groups[gid]
+    var servers []string
+    ok := false
+    if len(ck.config.Shards) > 0 { // none until the first Query
+      shard := key2shard(key, len(ck.config.Shards))
+      gid := ck.config.Shards[shard]
+      servers, ok = ck.config.Groups[gid]
+    }
 
     if ok {
       // try each server in the shard's replication group.
       for _, srv := range servers {
+        if ctx.Err() != nil {
+          return "", ctxErr(ctx, last)
+        }
         args := &GetArgs{}
         args.Key = key
         var reply GetReply
-        ok := call(srv, "ShardKV.Get", args, &reply)
-        if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-          return reply.Value
+        ok := callContext(ctx, srv, "ShardKV.Get", args, &reply)
+        if ok && reply.Err == OK {
+          return reply.Value, nil
+        }
+        if ok && reply.Err == ErrNoKey {
+          return "", ErrNoKey
+        }
+        if ok {
+          last = reply.Err
         }
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
-
     // ask master for a new configuration.
-    ck.config = ck.sm.Query(-1)
+    if !ck.refresh(ctx) {
+      return "", ctxErr(ctx, last)
+    }
   }
-  return ""
 }
 
 func (ck *Clerk) Put(key string, value string) {
+  ck.PutContext(context.Background(), key, value)
+}
+
+//
+// like Put, but gives up when ctx ends; see ctxErr() for
+// the errors. a Put given up on may still happen later.
+//
+func (ck *Clerk) PutContext(ctx context.Context, key string, value string) error {
   ck.mu.Lock()
   defer ck.mu.Unlock()
 
-
-  // You'll have to modify Put().
-
+  var last Err
   for {
-    shard := key2shard(key)
-
-    gid := ck.config.Shards[shard]
-
-    servers, ok := ck.config.Groups[gid]
-
+    var servers []string
+    ok := false
+    if len(ck.config.Shards) > 0 { // none until the first Query
+      shard := key2shard(key, len(ck.config.Shards))
+      gid := ck.config.Shards[shard]
+      servers, ok = ck.config.Groups[gid]
+    }
 
     if ok {
       // try each server in the shard's replication group.
       for _, srv := range servers {
+        if ctx.Err() != nil {
+          return ctxErr(ctx, last)
+        }
         args := &PutArgs{}
         args.Key = key
         args.Value = value
         var reply PutReply
-        ok := call(srv, "ShardKV.Put", args, &reply)
+        ok := callContext(ctx, srv, "ShardKV.Put", args, &reply)
         if ok && reply.Err == OK {
-          return
+          return nil
+        }
+        if ok {
+          last = reply.Err
         }
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
-
     // ask master for a new configuration.
-    ck.config = ck.sm.Query(-1)
+    if !ck.refresh(ctx) {
+      return ctxErr(ctx, last)
+    }
   }
 }
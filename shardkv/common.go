@@ -11,11 +11,23 @@ package shardkv
 
 const (
   OK = "OK"
-  ErrNoKey = "ErrNoKey"
-  ErrWrongGroup = "ErrWrongGroup"
+)
+
+const (
+  ErrNoKey Err = "ErrNoKey"
+  ErrWrongGroup Err = "ErrWrongGroup"
+  ErrTimeout Err = "ErrTimeout" // no group answered before the deadline
 )
 type Err string
 
+//
+// lets the Clerk return ErrNoKey, and ErrWrongGroup when the
+// key's shard kept moving until ctx ended.
+//
+func (e Err) Error() string {
+  return string(e)
+}
+
 type PutArgs struct {
   Key string
   Value string
@@ -0,0 +1,67 @@
+package shardkv
+
+//
+// telling the shardmaster how loaded this server's shards are,
+// so it can move shards off a group that stays hot. each server
+// counts the requests it serves and the bytes Put under each
+// key, and every reportInterval reports the request rate and
+// size of each shard it served.
+//
+
+import "time"
+import "context"
+import "shardmaster"
+
+const reportInterval = time.Second
+
+//
+// note a request for key; size is the length of the value
+// a Put stored, or -1 for a Get.
+//
+func (kv *ShardKV) served(key string, size int) {
+  kv.mu.Lock()
+  defer kv.mu.Unlock()
+  if len(kv.config.Shards) == 0 {
+    return
+  }
+  kv.requests[key2shard(key, len(kv.config.Shards))]++
+  if size >= 0 {
+    kv.sizes[key] = len(key) + size
+  }
+}
+
+//
+// send the loads since the last report, if it's time.
+//
+func (kv *ShardKV) report() {
+  kv.mu.Lock()
+  elapsed := time.Since(kv.lastReport)
+  if elapsed < reportInterval || len(kv.config.Shards) == 0 {
+    kv.mu.Unlock()
+    return
+  }
+  nshards := len(kv.config.Shards)
+  bytes := map[int]int{}
+  for key, size := range kv.sizes {
+    bytes[key2shard(key, nshards)] += size
+  }
+  loads := []shardmaster.ShardLoad{}
+  for shard := 0; shard < nshards; shard++ {
+    if kv.requests[shard] == 0 && bytes[shard] == 0 {
+      continue
+    }
+    load := shardmaster.ShardLoad{}
+    load.Shard = shard
+    load.Rate = float64(kv.requests[shard]) / elapsed.Seconds()
+    load.Bytes = bytes[shard]
+    loads = append(loads, load)
+  }
+  num := kv.config.Num
+  kv.requests = map[int]int{}
+  kv.lastReport = time.Now()
+  kv.mu.Unlock()
+
+  ctx, cancel := context.WithTimeout(context.Background(), reportInterval / 2)
+  defer cancel()
+  kv.sm.ReportContext(ctx, kv.gid, kv.name, num, loads)
+}
@@ -12,6 +12,7 @@ import "syscall"
 import "encoding/gob"
 import "math/rand"
 import "shardmaster"
+import "context"
 
 
 type Op struct {
@@ -30,18 +31,25 @@ type ShardKV struct {
   gid int64 // my replica group ID
 
   // Your definitions here.
+  name string // my port, servers[me]
+  config shardmaster.Config // latest known
+  requests map[int]int // per shard, since the last report
+  sizes map[string]int // bytes Put under each key
+  lastReport time.Time
 }
 
 
 func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) error {
 
   // Your code here.
+  kv.served(args.Key, -1)
 
   return nil
 }
 
 func (kv *ShardKV) Put(args *PutArgs, reply *PutReply) error {
   // Your code here.
+  kv.served(args.Key, len(args.Value))
 
   return nil
 }
@@ -51,6 +59,14 @@ func (kv *ShardKV) Put(args *PutArgs, reply *PutReply) error {
 // if so, re-configure.
 //
 func (kv *ShardKV) tick() {
+  ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+  defer cancel()
+  if config, err := kv.sm.QueryContext(ctx, -1); err == nil {
+    kv.mu.Lock()
+    kv.config = config
+    kv.mu.Unlock()
+  }
+  kv.report()
 }
 
 
@@ -81,6 +97,10 @@ func StartServer(gid int64, shardmasters []string,
   kv.sm = shardmaster.MakeClerk(shardmasters)
 
   // Your initialization code here.
+  kv.name = servers[me]
+  kv.requests = map[int]int{}
+  kv.sizes = map[string]int{}
+  kv.lastReport = time.Now()
 
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
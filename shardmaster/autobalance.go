@@ -0,0 +1,280 @@
+package shardmaster
+
+//
+// moving shards off groups that stay hot.
+//
+// sm.SetAutoBalance(policy AutoBalance) -- turn automatic moves on
+// sm.DryRunMoves() []MoveArgs -- the moves a dry run chose
+//
+// shardkv servers Report() the request rate and size of each
+// shard they serve. every policy.Interval, each replica adds up
+// the recent reports, and a group carrying more than HotRatio
+// times its weighted share of the requests for HotChecks checks
+// in a row has one shard moved to the group with the least
+// load per weight, picking the shard that best evens the two
+// out and, between equals, the one with the least data.
+//
+// the move goes through the log like any other, but only takes
+// effect if the config it was chosen against is still the
+// latest and at least MinGap has passed since the last
+// automatic move, so replicas proposing at once make one move.
+// reports themselves are not logged: each replica keeps those
+// it hears, and a lost one is replaced by the next.
+//
+
+import "time"
+import "sort"
+
+type AutoBalance struct {
+  Interval time.Duration // how often to check; 0 turns it off
+  HotRatio float64 // hot means over HotRatio times its share
+  HotChecks int // checks in a row a group must be hot for
+  MinGap time.Duration // least time between automatic moves
+  DryRun bool // only record the moves, for DryRunMoves()
+}
+
+type report struct {
+  args ReportArgs
+  at time.Time
+}
+
+func (sm *ShardMaster) SetAutoBalance(policy AutoBalance) {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  sm.policy = policy
+  sm.hot = map[int64]int{}
+}
+
+func (sm *ShardMaster) DryRunMoves() []MoveArgs {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  return append([]MoveArgs{}, sm.dryRuns...)
+}
+
+func (sm *ShardMaster) Report(args *ReportArgs, reply *ReportReply) error {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  sm.reports[args.Server] = report{*args, time.Now()}
+  return nil
+}
+
+func (sm *ShardMaster) autoBalancer() {
+  for !sm.dead {
+    sm.mu.Lock()
+    interval := sm.policy.Interval
+    sm.mu.Unlock()
+    if interval == 0 {
+      time.Sleep(100 * time.Millisecond)
+      continue
+    }
+    time.Sleep(interval)
+    sm.checkLoad()
+  }
+}
+
+func (sm *ShardMaster) checkLoad() {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+  policy := sm.policy
+  if policy.Interval == 0 || sm.dead {
+    return
+  }
+
+  //catch up, so the move is chosen against the latest config
+  op := Op{}
+  op.Type = QUERY
+  sm.agree(op)
+  config := sm.configs[len(sm.configs)-1]
+
+  now := time.Now()
+  loads := map[int]ShardLoad{}
+  for server, r := range sm.reports {
+    if now.Sub(r.at) > 3 * policy.Interval {
+      delete(sm.reports, server)
+    }
+  }
+  for _, r := range sm.reports {
+    for _, load := range r.args.Loads {
+      if load.Shard < 0 || load.Shard >= len(config.Shards) {
+        continue
+      }
+      if config.Shards[load.Shard] != r.args.GID {
+        continue
+      }
+      //a group's servers each see part of its requests
+      sum := loads[load.Shard]
+      sum.Shard = load.Shard
+      sum.Rate += load.Rate
+      if load.Bytes > sum.Bytes {
+        sum.Bytes = load.Bytes
+      }
+      loads[load.Shard] = sum
+    }
+  }
+
+  from, ok := sm.hottest(config, loads, policy)
+  if !ok {
+    return
+  }
+  last := sm.lastAutoMove
+  if policy.DryRun {
+    last = sm.lastDryRun
+  }
+  if now.UnixNano() - last < int64(policy.MinGap) {
+    return
+  }
+  move, ok := pickMove(config, loads, from)
+  if !ok {
+    return
+  }
+  sm.hot[from] = 0
+
+  if policy.DryRun {
+    sm.dryRuns = append(sm.dryRuns, move)
+    sm.lastDryRun = now.UnixNano()
+    return
+  }
+  op = Op{}
+  op.Type = AUTOMOVE
+  op.Shard = move.Shard
+  op.GID = move.GID
+  op.Num = config.Num
+  op.When = now.UnixNano()
+  op.Gap = int64(policy.MinGap)
+  sm.agree(op)
+}
+
+//
+// count another check for the groups over their share, and
+// return the hottest one that has been for policy.HotChecks
+// checks in a row.
+//
+func (sm *ShardMaster) hottest(config Config, loads map[int]ShardLoad, policy AutoBalance) (int64, bool) {
+  perWeight := groupLoads(config, loads)
+  total, weights := 0.0, 0
+  for gid := range config.Groups {
+    total += perWeight[gid] * float64(weightOf(config, gid))
+    weights += weightOf(config, gid)
+  }
+  if total == 0 {
+    sm.hot = map[int64]int{}
+    return 0, false
+  }
+  average := total / float64(weights)
+
+  hot := map[int64]int{}
+  found := false
+  var from int64
+  for _, gid := range sortedGroups(config) {
+    if perWeight[gid] <= policy.HotRatio * average {
+      continue
+    }
+    hot[gid] = sm.hot[gid] + 1
+    if hot[gid] >= policy.HotChecks && (!found || perWeight[gid] > perWeight[from]) {
+      from = gid
+      found = true
+    }
+  }
+  sm.hot = hot
+  return from, found
+}
+
+func weightOf(config Config, gid int64) int {
+  if config.Weights[gid] <= 0 {
+    return 1
+  }
+  return config.Weights[gid]
+}
+
+func sortedGroups(config Config) []int64 {
+  gids := []int64{}
+  for gid := range config.Groups {
+    gids = append(gids, gid)
+  }
+  sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+  return gids
+}
+
+//
+// each group's request rate divided by its weight.
+//
+func groupLoads(config Config, loads map[int]ShardLoad) map[int64]float64 {
+  perWeight := map[int64]float64{}
+  for gid := range config.Groups {
+    perWeight[gid] = 0
+  }
+  for shard, gid := range config.Shards {
+    if _, ok := perWeight[gid]; ok {
+      perWeight[gid] += loads[shard].Rate / float64(weightOf(config, gid))
+    }
+  }
+  return perWeight
+}
+
+//
+// the shard to move off group from, and the group to take it:
+// the one with the least load per weight. the shard chosen
+// leaves the busier of the two as idle as possible, and a
+// shard that would leave it no better off, or would join
+// another from its anti-affinity set, is never chosen.
+// false if no shard qualifies.
+//
+func pickMove(config Config, loads map[int]ShardLoad, from int64) (MoveArgs, bool) {
+  perWeight := groupLoads(config, loads)
+  to := int64(0)
+  for _, gid := range sortedGroups(config) {
+    if gid != from && (to == 0 || perWeight[gid] < perWeight[to]) {
+      to = gid
+    }
+  }
+  if to == 0 {
+    return MoveArgs{}, false
+  }
+
+  wfrom := float64(weightOf(config, from))
+  wto := float64(weightOf(config, to))
+  best := -1
+  bestPeak := perWeight[from]
+  for shard, gid := range config.Shards {
+    if gid != from || loads[shard].Rate == 0 || together(config, shard, to) {
+      continue
+    }
+    rate := loads[shard].Rate
+    peak := perWeight[from] - rate / wfrom
+    if other := perWeight[to] + rate / wto; other > peak {
+      peak = other
+    }
+    if peak < bestPeak || (best >= 0 && peak == bestPeak && loads[shard].Bytes < loads[best].Bytes) {
+      best = shard
+      bestPeak = peak
+    }
+  }
+  if best < 0 {
+    return MoveArgs{}, false
+  }
+  return MoveArgs{best, to}, true
+}
+
+//
+// whether gid holds a shard from one of shard's
+// anti-affinity sets.
+//
+func together(config Config, shard int, gid int64) bool {
+  for _, set := range config.AntiAffinity {
+    in := false
+    for _, s := range set {
+      if s == shard {
+        in = true
+      }
+    }
+    if !in {
+      continue
+    }
+    for _, s := range set {
+      if s != shard && s >= 0 && s < len(config.Shards) && config.Shards[s] == gid {
+        return true
+      }
+    }
+  }
+  return false
+}
@@ -0,0 +1,223 @@
+package shardmaster
+
+//
+// choosing which group serves each shard.
+//
+// balance(config) -> the new owner of each of config's shards
+//
+// every group ends up within one shard of its share, which is
+// proportional to its weight, and as few shards as possible
+// change owner, since each one that does is data shardkv has
+// to migrate. Move() assigns a shard without rebalancing, so a
+// moved shard stays put until the next Join or Leave, which may
+// move it again to even the groups out.
+//
+// shards in the same anti-affinity set are kept on different
+// groups, and in different zones when a group with room is
+// free of the set's other shards. this is best effort: the
+// shares come first, and shards already placed only move to
+// undo a clash, by swapping if need be, not to find a better
+// zone.
+//
+
+import "sort"
+
+//
+// the new owner of each of config.Shards, given the groups,
+// weights, zones and anti-affinity sets in config. shards owned
+// by a group not in config.Groups (including 0, no group) must
+// move; otherwise a group keeps its shards unless it has more
+// than its share, or two from one set. with no groups every
+// shard goes to 0. the result depends only on config, not on
+// map iteration order, so every replica computes the same
+// configuration. config is not changed.
+//
+func balance(config Config) []int64 {
+  shards := config.Shards
+  result := make([]int64, len(shards))
+  if len(config.Groups) == 0 {
+    return result
+  }
+
+  owned := map[int64][]int{}
+  for gid := range config.Groups {
+    owned[gid] = []int{}
+  }
+  free := []int{}
+  for shard, gid := range shards {
+    if _, ok := owned[gid]; ok {
+      owned[gid] = append(owned[gid], shard)
+    } else {
+      free = append(free, shard)
+    }
+  }
+
+  //the groups that already have the most come first, so
+  //they keep the remainder and the fewest shards move
+  order := make([]int64, 0, len(owned))
+  for gid := range owned {
+    order = append(order, gid)
+  }
+  sort.Slice(order, func(i, j int) bool {
+    if len(owned[order[i]]) != len(owned[order[j]]) {
+      return len(owned[order[i]]) > len(owned[order[j]])
+    }
+    return order[i] < order[j]
+  })
+  target := shares(order, config.Weights, len(shards))
+
+  //the sets each shard is in
+  sets := map[int][]int{}
+  for i, set := range config.AntiAffinity {
+    for _, shard := range set {
+      if shard >= 0 && shard < len(shards) {
+        sets[shard] = append(sets[shard], i)
+      }
+    }
+  }
+  //whether one of group's shards shares a set with shard
+  clash := func(shard int, group []int) bool {
+    for _, i := range sets[shard] {
+      for _, other := range group {
+        if other == shard {
+          continue
+        }
+        for _, j := range sets[other] {
+          if i == j {
+            return true
+          }
+        }
+      }
+    }
+    return false
+  }
+  //whether a group in gid's zone holds a shard from one of
+  //shard's sets
+  zoneClash := func(shard int, gid int64) bool {
+    zone := config.Zones[gid]
+    if zone == "" {
+      return false
+    }
+    for _, other := range order {
+      if config.Zones[other] == zone && clash(shard, owned[other]) {
+        return true
+      }
+    }
+    return false
+  }
+
+  for _, gid := range order {
+    kept := []int{}
+    for _, shard := range owned[gid] {
+      if clash(shard, kept) {
+        free = append(free, shard)
+      } else {
+        kept = append(kept, shard)
+      }
+    }
+    for len(kept) > target[gid] {
+      last := len(kept) - 1
+      free = append(free, kept[last])
+      kept = kept[:last]
+    }
+    owned[gid] = kept
+  }
+
+  //each free shard goes to the first group with room, unless
+  //a later one avoids a clash
+  sort.Ints(free)
+  for _, shard := range free {
+    best := int64(0)
+    bestScore := 0
+    for _, gid := range order {
+      if len(owned[gid]) >= target[gid] {
+        continue
+      }
+      score := 0
+      if clash(shard, owned[gid]) {
+        score += 2
+      }
+      if zoneClash(shard, gid) {
+        score += 1
+      }
+      if best == 0 || score < bestScore {
+        best = gid
+        bestScore = score
+      }
+    }
+    owned[best] = append(owned[best], shard)
+  }
+
+  //a clash that came back because no other group had room
+  //is undone by swapping with a shard from another group
+  swapped := func(shards []int, i int, shard int) []int {
+    result := append([]int{}, shards...)
+    result[i] = shard
+    return result
+  }
+  for _, gid := range order {
+    for i, shard := range owned[gid] {
+      if !clash(shard, owned[gid]) {
+        continue
+      }
+    search:
+      for _, other := range order {
+        if other == gid {
+          continue
+        }
+        for j, x := range owned[other] {
+          mine := swapped(owned[gid], i, x)
+          theirs := swapped(owned[other], j, shard)
+          if !clash(x, mine) && !clash(shard, theirs) {
+            owned[gid] = mine
+            owned[other] = theirs
+            break search
+          }
+        }
+      }
+    }
+  }
+
+  for _, gid := range order {
+    for _, shard := range owned[gid] {
+      result[shard] = gid
+    }
+  }
+  return result
+}
+
+//
+// how many of nshards shards each group in order should
+// have: nshards * weight / total weight, rounded down, with
+// the shards left over going to the groups that lost the most
+// to rounding, earlier groups first. a missing or non-positive
+// weight counts as 1.
+//
+func shares(order []int64, weights map[int64]int, nshards int) map[int64]int {
+  weight := func(gid int64) int {
+    if weights[gid] <= 0 {
+      return 1
+    }
+    return weights[gid]
+  }
+  total := 0
+  for _, gid := range order {
+    total += weight(gid)
+  }
+
+  target := map[int64]int{}
+  left := nshards
+  for _, gid := range order {
+    target[gid] = nshards * weight(gid) / total
+    left -= target[gid]
+  }
+  byRemainder := append([]int64{}, order...)
+  sort.SliceStable(byRemainder, func(i, j int) bool {
+    return nshards * weight(byRemainder[i]) % total >
+           nshards * weight(byRemainder[j]) % total
+  })
+  for i := 0; i < left; i++ {
+    target[byRemainder[i]]++
+  }
+  return target
+}
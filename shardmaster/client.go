@@ -6,6 +6,7 @@ package shardmaster
 //
 
 import "net/rpc"
+import "context"
 import "time"
 
 type Clerk struct {
@@ -49,69 +50,179 @@ func call(srv string, rpcname string,
   return false
 }
 
-func (ck *Clerk) Query(num int) Config {
-  for {
-    // try each known server.
-    for _, srv := range ck.servers {
-      args := &QueryArgs{}
-      args.Num = num
-      var reply QueryReply
-      ok := call(srv, "ShardMaster.Query", args, &reply)
-      if ok {
-        return reply.Config
-      }
-    }
-    time.Sleep(100 * time.Millisecond)
+//
+// call() that gives up when ctx ends, which can be long
+// before a replica cut off from a paxos majority answers.
+//
+func callContext(ctx context.Context, srv string, rpcname string,
+                 args interface{}, reply interface{}) bool {
+  done := make(chan bool, 1)
+  go func() {
+    done <- call(srv, rpcname, args, reply)
+  }()
+  select {
+  case ok := <-done:
+    return ok
+  case <-ctx.Done():
+    return false
   }
-  return Config{}
 }
 
-func (ck *Clerk) Join(gid int64, servers []string) {
+//
+// ErrTimeout if ctx's deadline passed before any replica
+// answered, else ctx.Err().
+//
+func ctxErr(ctx context.Context) error {
+  if ctx.Err() == context.DeadlineExceeded {
+    return ErrTimeout
+  }
+  return ctx.Err()
+}
+
+//
+// send one RPC to the servers in turn until one answers,
+// or ctx ends. newReply gives each try its own reply, since
+// one given up on may still be written to.
+//
+func (ck *Clerk) send(ctx context.Context, rpcname string,
+                      args interface{}, newReply func() interface{}) (interface{}, error) {
   for {
     // try each known server.
     for _, srv := range ck.servers {
-      args := &JoinArgs{}
-      args.GID = gid
-      args.Servers = servers
-      var reply JoinReply
-      ok := call(srv, "ShardMaster.Join", args, &reply)
-      if ok {
-        return
+      if ctx.Err() != nil {
+        return nil, ctxErr(ctx)
       }
+      reply := newReply()
+      if callContext(ctx, srv, rpcname, args, reply) {
+        return reply, nil
+      }
+    }
+    select {
+    case <-ctx.Done():
+      return nil, ctxErr(ctx)
+    case <-time.After(100 * time.Millisecond):
     }
-    time.Sleep(100 * time.Millisecond)
   }
 }
 
+func (ck *Clerk) Query(num int) Config {
+  config, _ := ck.QueryContext(context.Background(), num)
+  return config
+}
+
+//
+// like Query, but gives up when ctx ends, returning
+// ErrTimeout if its deadline passed.
+//
+func (ck *Clerk) QueryContext(ctx context.Context, num int) (Config, error) {
+  args := &QueryArgs{}
+  args.Num = num
+  reply, err := ck.send(ctx, "ShardMaster.Query", args,
+                        func() interface{} { return &QueryReply{} })
+  if err != nil {
+    return Config{}, err
+  }
+  return reply.(*QueryReply).Config, nil
+}
+
+func (ck *Clerk) Join(gid int64, servers []string) {
+  ck.JoinContext(context.Background(), gid, servers)
+}
+
+func (ck *Clerk) JoinContext(ctx context.Context, gid int64, servers []string) error {
+  return ck.JoinWeightedContext(ctx, gid, servers, 1, "")
+}
+
+//
+// like Join, for a group that should get weight times
+// as many shards as a group of weight 1, in zone.
+//
+func (ck *Clerk) JoinWeighted(gid int64, servers []string, weight int, zone string) {
+  ck.JoinWeightedContext(context.Background(), gid, servers, weight, zone)
+}
+
+func (ck *Clerk) JoinWeightedContext(ctx context.Context, gid int64, servers []string,
+                                     weight int, zone string) error {
+  args := &JoinArgs{}
+  args.GID = gid
+  args.Servers = servers
+  args.Weight = weight
+  args.Zone = zone
+  _, err := ck.send(ctx, "ShardMaster.Join", args,
+                    func() interface{} { return &JoinReply{} })
+  return err
+}
+
 func (ck *Clerk) Leave(gid int64) {
-  for {
-    // try each known server.
-    for _, srv := range ck.servers {
-      args := &LeaveArgs{}
-      args.GID = gid
-      var reply LeaveReply
-      ok := call(srv, "ShardMaster.Leave", args, &reply)
-      if ok {
-        return
-      }
-    }
-    time.Sleep(100 * time.Millisecond)
+  ck.LeaveContext(context.Background(), gid)
+}
+
+func (ck *Clerk) LeaveContext(ctx context.Context, gid int64) error {
+  args := &LeaveArgs{}
+  args.GID = gid
+  _, err := ck.send(ctx, "ShardMaster.Leave", args,
+                    func() interface{} { return &LeaveReply{} })
+  return err
+}
+
+func (ck *Clerk) Split() {
+  ck.SplitContext(context.Background())
+}
+
+func (ck *Clerk) SplitContext(ctx context.Context) error {
+  args := &SplitArgs{}
+  _, err := ck.send(ctx, "ShardMaster.Split", args,
+                    func() interface{} { return &SplitReply{} })
+  return err
+}
+
+func (ck *Clerk) SetAntiAffinity(sets [][]int) {
+  ck.SetAntiAffinityContext(context.Background(), sets)
+}
+
+func (ck *Clerk) SetAntiAffinityContext(ctx context.Context, sets [][]int) error {
+  args := &SetAntiAffinityArgs{}
+  args.Sets = sets
+  _, err := ck.send(ctx, "ShardMaster.SetAntiAffinity", args,
+                    func() interface{} { return &SetAntiAffinityReply{} })
+  return err
+}
+
+//
+// tell the shardmaster servers how loaded gid's shards
+// are. reports are only a hint, so each server is tried
+// once; a lost report is replaced by the next one.
+//
+func (ck *Clerk) Report(gid int64, server string, num int, loads []ShardLoad) {
+  ck.ReportContext(context.Background(), gid, server, num, loads)
+}
+
+func (ck *Clerk) ReportContext(ctx context.Context, gid int64, server string,
+                               num int, loads []ShardLoad) error {
+  args := &ReportArgs{}
+  args.GID = gid
+  args.Server = server
+  args.Num = num
+  args.Loads = loads
+  for _, srv := range ck.servers {
+    var reply ReportReply
+    callContext(ctx, srv, "ShardMaster.Report", args, &reply)
+  }
+  if ctx.Err() != nil {
+    return ctxErr(ctx)
   }
+  return nil
 }
 
 func (ck *Clerk) Move(shard int, gid int64) {
-  for {
-    // try each known server.
-    for _, srv := range ck.servers {
-      args := &MoveArgs{}
-      args.Shard = shard
-      args.GID = gid
-      var reply LeaveReply
-      ok := call(srv, "ShardMaster.Move", args, &reply)
-      if ok {
-        return
-      }
-    }
-    time.Sleep(100 * time.Millisecond)
-  }
+  ck.MoveContext(context.Background(), shard, gid)
+}
+
+func (ck *Clerk) MoveContext(ctx context.Context, shard int, gid int64) error {
+  args := &MoveArgs{}
+  args.Shard = shard
+  args.GID = gid
+  _, err := ck.send(ctx, "ShardMaster.Move", args,
+                    func() interface{} { return &MoveReply{} })
+  return err
 }
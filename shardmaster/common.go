@@ -8,11 +8,25 @@ package shardmaster
 // Leave(gid) -- replica group gid is retiring, hand off all its shards.
 // Move(shard, gid) -- hand off one shard from current owner to gid.
 // Query(num) -> fetch Config # num, or latest config if num==-1.
+// Split() -- double the number of shards.
+// SetAntiAffinity(sets) -- keep the shards of each set on different groups.
+// Report(args) -- a group server's recent load on each of its shards.
 //
 // A Config (configuration) describes a set of replica groups, and the
 // replica group responsible for each shard. Configs are numbered. Config
 // #0 is the initial configuration, with no groups and all shards
-// assigned to group 0 (the invalid group).
+// assigned to group 0 (the invalid group). The number of shards is
+// chosen when the shardmaster starts, and is len(Config.Shards).
+// Split() doubles it: with keys hashed to shards modulo the count,
+// new shards i and i+n together hold the keys of old shard i, and
+// start out with its owner. nothing moves if the doubled layout is
+// balanced; if not (4/3/3 doubles to 8/6/6, against 7/7/6), the
+// fewest shards needed to even it out move at once.
+//
+// Groups join with a weight, and get shards in proportion to it,
+// and optionally a zone. Shards in an anti-affinity set are kept
+// on different groups, and where possible in different zones, as
+// far as the weights allow.
 //
 // A GID is a replica group ID. GIDs must be uniqe and > 0.
 // Once a GID joins, and leaves, it should never join again.
@@ -20,17 +34,35 @@ package shardmaster
 // Please don't change this file.
 //
 
-const NShards = 10
+const NShards = 10 // the number of shards StartServer() starts with
+
+const (
+  ErrTimeout Err = "ErrTimeout" // no server answered before the deadline
+)
+type Err string
+
+//
+// the master itself never fails a request, so ErrTimeout is
+// the only Err a ...Context method returns.
+//
+func (e Err) Error() string {
+  return string(e)
+}
 
 type Config struct {
   Num int // config number
-  Shards [NShards]int64 // gid
+  Shards []int64 // gid of each shard
   Groups map[int64][]string // gid -> servers[]
+  Weights map[int64]int // gid -> weight, relative to other groups
+  Zones map[int64]string // gid -> zone, "" if none
+  AntiAffinity [][]int // sets of shards to keep apart
 }
 
 type JoinArgs struct {
   GID int64       // unique replica group ID
   Servers []string // group server ports
+  Weight int // share of the shards relative to other groups; 0 means 1
+  Zone string // failure domain, e.g. a rack; "" if none
 }
 
 type JoinReply struct {
@@ -51,6 +83,35 @@ type MoveArgs struct {
 type MoveReply struct {
 }
 
+type SplitArgs struct {
+}
+
+type SplitReply struct {
+}
+
+type SetAntiAffinityArgs struct {
+  Sets [][]int // replaces the current sets
+}
+
+type SetAntiAffinityReply struct {
+}
+
+type ShardLoad struct {
+  Shard int
+  Rate float64 // requests per second
+  Bytes int // size of the shard's data
+}
+
+type ReportArgs struct {
+  GID int64
+  Server string // which of the group's servers measured Loads
+  Num int // the config Loads were measured under
+  Loads []ShardLoad
+}
+
+type ReportReply struct {
+}
+
 type QueryArgs struct {
     Num int // desired config number
 }
@@ -10,6 +10,7 @@ import "os"
 import "syscall"
 import "encoding/gob"
 import "math/rand"
+import "time"
 
 type ShardMaster struct {
   mu sync.Mutex
@@ -20,35 +21,253 @@ type ShardMaster struct {
   px *paxos.Paxos
 
   configs []Config // indexed by config num
+  currentSeq int // next instance to apply
+
+  reports map[string]report // latest from each group server
+  policy AutoBalance
+  hot map[int64]int // checks in a row each group has been hot
+  lastAutoMove int64 // When of the last automatic move applied
+  lastDryRun int64 // when a dry run last recorded a move
+  dryRuns []MoveArgs
 }
 
 
 type Op struct {
   // Your data here.
+  Type string
+  ID int64 // tells apart ops with the same arguments
+  GID int64
+  Servers []string
+  Shard int
+  Weight int
+  Zone string
+  Sets [][]int
+  Num int // AUTOMOVE: the config the move was chosen against
+  When int64 // AUTOMOVE: when it was proposed, in ns
+  Gap int64 // AUTOMOVE: least ns since the last one
+}
+
+const (
+  JOIN = "JOIN"
+  LEAVE = "LEAVE"
+  MOVE = "MOVE"
+  QUERY = "QUERY"
+  SPLIT = "SPLIT"
+  ANTIAFFINITY = "ANTIAFFINITY"
+  AUTOMOVE = "AUTOMOVE"
+)
+
+//
+// agree on op as the value of the first instance from
+// sm.currentSeq on that nobody else has taken, and return
+// that instance. call with sm.mu held.
+//
+func (sm *ShardMaster) Paxos(op Op) int {
+  seq := sm.currentSeq
+  for !sm.dead {
+    sm.px.Start(seq, op)
+    decided, v := sm.px.WaitDecided(seq, time.Second)
+    if !decided {
+      //our proposal may have been lost; propose again
+      continue
+    }
+    if actualOp, ok := v.(Op); ok && actualOp.ID == op.ID {
+      break
+    }
+    seq++
+  }
+  return seq
 }
 
+//
+// apply every instance from sm.currentSeq through seq,
+// in order. call with sm.mu held.
+//
+func (sm *ShardMaster) UpdateLocalLog(seq int) {
+  for ; sm.currentSeq <= seq; sm.currentSeq++ {
+    _, v := sm.px.Status(sm.currentSeq)
+    if op, ok := v.(Op); ok {
+      sm.apply(op)
+    }
+  }
+  sm.px.Done(seq)
+}
+
+func (sm *ShardMaster) apply(op Op) {
+  switch op.Type {
+  case JOIN:
+    config := sm.nextConfig()
+    config.Groups[op.GID] = op.Servers
+    config.Weights[op.GID] = op.Weight
+    if op.Weight <= 0 {
+      config.Weights[op.GID] = 1
+    }
+    config.Zones[op.GID] = op.Zone
+    sm.rebalance(config)
+  case LEAVE:
+    config := sm.nextConfig()
+    delete(config.Groups, op.GID)
+    delete(config.Weights, op.GID)
+    delete(config.Zones, op.GID)
+    sm.rebalance(config)
+  case MOVE:
+    config := sm.nextConfig()
+    if op.Shard >= 0 && op.Shard < len(config.Shards) {
+      config.Shards[op.Shard] = op.GID
+    }
+  case SPLIT:
+    config := sm.nextConfig()
+    //old shard i is now shards i and i+n; keep both halves of
+    //a set apart the way the set was
+    n := len(config.Shards)
+    config.Shards = append(config.Shards, config.Shards...)
+    for _, set := range config.AntiAffinity {
+      upper := []int{}
+      for _, shard := range set {
+        upper = append(upper, shard + n)
+      }
+      config.AntiAffinity = append(config.AntiAffinity, upper)
+    }
+    sm.rebalance(config)
+  case ANTIAFFINITY:
+    config := sm.nextConfig()
+    config.AntiAffinity = op.Sets
+    sm.rebalance(config)
+  case AUTOMOVE:
+    //several replicas may propose moves; only the first
+    //against a config, and only after the gap, happens
+    latest := sm.configs[len(sm.configs)-1]
+    if latest.Num != op.Num || op.When - sm.lastAutoMove < op.Gap {
+      return
+    }
+    if _, ok := latest.Groups[op.GID]; !ok {
+      return
+    }
+    config := sm.nextConfig()
+    config.Shards[op.Shard] = op.GID
+    sm.lastAutoMove = op.When
+  }
+}
+
+//
+// append a copy of the latest configuration, numbered one
+// higher, and return it for the caller to change.
+//
+func (sm *ShardMaster) nextConfig() *Config {
+  latest := sm.configs[len(sm.configs)-1]
+  config := Config{}
+  config.Num = latest.Num + 1
+  config.Shards = append([]int64{}, latest.Shards...)
+  config.Groups = map[int64][]string{}
+  for gid, servers := range latest.Groups {
+    config.Groups[gid] = servers
+  }
+  config.Weights = map[int64]int{}
+  for gid, weight := range latest.Weights {
+    config.Weights[gid] = weight
+  }
+  config.Zones = map[int64]string{}
+  for gid, zone := range latest.Zones {
+    config.Zones[gid] = zone
+  }
+  config.AntiAffinity = append([][]int{}, latest.AntiAffinity...)
+  sm.configs = append(sm.configs, config)
+  return &sm.configs[len(sm.configs)-1]
+}
+
+//
+// reassign config's shards to its current groups; see balance().
+//
+func (sm *ShardMaster) rebalance(config *Config) {
+  config.Shards = balance(*config)
+}
+
+//
+// put op in the log and apply everything up to it.
+//
+func (sm *ShardMaster) agree(op Op) {
+  op.ID = rand.Int63()
+  seq := sm.Paxos(op)
+  sm.UpdateLocalLog(seq)
+}
 
 func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
   // Your code here.
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
 
+  op := Op{}
+  op.Type = JOIN
+  op.GID = args.GID
+  op.Servers = args.Servers
+  op.Weight = args.Weight
+  op.Zone = args.Zone
+  sm.agree(op)
   return nil
 }
 
 func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
   // Your code here.
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
 
+  op := Op{}
+  op.Type = LEAVE
+  op.GID = args.GID
+  sm.agree(op)
   return nil
 }
 
 func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
   // Your code here.
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+
+  op := Op{}
+  op.Type = MOVE
+  op.Shard = args.Shard
+  op.GID = args.GID
+  sm.agree(op)
+  return nil
+}
+
+func (sm *ShardMaster) Split(args *SplitArgs, reply *SplitReply) error {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
 
+  op := Op{}
+  op.Type = SPLIT
+  sm.agree(op)
+  return nil
+}
+
+func (sm *ShardMaster) SetAntiAffinity(args *SetAntiAffinityArgs, reply *SetAntiAffinityReply) error {
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+
+  op := Op{}
+  op.Type = ANTIAFFINITY
+  op.Sets = args.Sets
+  sm.agree(op)
   return nil
 }
 
 func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
   // Your code here.
+  sm.mu.Lock()
+  defer sm.mu.Unlock()
+
+  //through the log, so no Join this replica hasn't
+  //heard of can precede the Query
+  op := Op{}
+  op.Type = QUERY
+  sm.agree(op)
 
+  if args.Num < 0 || args.Num >= len(sm.configs) {
+    reply.Config = sm.configs[len(sm.configs)-1]
+  } else {
+    reply.Config = sm.configs[args.Num]
+  }
   return nil
 }
 
@@ -66,13 +285,26 @@ func (sm *ShardMaster) Kill() {
 // me is the index of the current server in servers[].
 // 
 func StartServer(servers []string, me int) *ShardMaster {
+  return StartServerShards(servers, me, NShards)
+}
+
+//
+// like StartServer, with nshards shards instead of NShards.
+// every replica must be given the same nshards.
+//
+func StartServerShards(servers []string, me int, nshards int) *ShardMaster {
   gob.Register(Op{})
 
   sm := new(ShardMaster)
   sm.me = me
 
   sm.configs = make([]Config, 1)
+  sm.configs[0].Shards = make([]int64, nshards)
   sm.configs[0].Groups = map[int64][]string{}
+  sm.configs[0].Weights = map[int64]int{}
+  sm.configs[0].Zones = map[int64]string{}
+  sm.reports = map[string]report{}
+  sm.hot = map[int64]int{}
 
   rpcs := rpc.NewServer()
   rpcs.Register(sm)
@@ -118,5 +350,7 @@ func StartServer(servers []string, me int) *ShardMaster {
     }
   }()
 
+  go sm.autoBalancer()
+
   return sm
 }
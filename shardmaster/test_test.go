@@ -4,7 +4,8 @@ import "testing"
 import "runtime"
 import "strconv"
 import "os"
-// import "time"
+import "time"
+import "context"
 import "fmt"
 import "math/rand"
 
@@ -144,9 +145,14 @@ func TestBasic(t *testing.T) {
     if c.Num != cfa[i].Num {
       t.Fatalf("historical Num wrong")
     }
-    if c.Shards != cfa[i].Shards {
+    if len(c.Shards) != len(cfa[i].Shards) {
       t.Fatalf("historical Shards wrong")
     }
+    for j := 0; j < len(c.Shards); j++ {
+      if c.Shards[j] != cfa[i].Shards[j] {
+        t.Fatalf("historical Shards wrong")
+      }
+    }
     if len(c.Groups) != len(cfa[i].Groups) {
       t.Fatalf("number of historical Groups is wrong")
     }
@@ -359,3 +365,481 @@ func TestFreshQuery(t *testing.T) {
   fmt.Printf("  ... Passed\n")
   os.Remove(portx)
 }
+
+func TestContext(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Context deadlines bound an unavailable master ...\n")
+
+  // nothing is listening here.
+  ck := MakeClerk([]string{port("context", 0), port("context", 1)})
+
+  ctx, cancel := context.WithTimeout(context.Background(), 300 * time.Millisecond)
+  defer cancel()
+  t0 := time.Now()
+  if _, err := ck.QueryContext(ctx, -1); err != ErrTimeout {
+    t.Fatalf("QueryContext with no servers: %v, want ErrTimeout", err)
+  }
+  if d := time.Since(t0); d > time.Second {
+    t.Fatalf("QueryContext returned %v after its deadline", d)
+  }
+
+  cctx, cancel2 := context.WithCancel(context.Background())
+  cancel2()
+  if err := ck.JoinContext(cctx, 1, []string{"a"}); err != context.Canceled {
+    t.Fatalf("JoinContext after cancel: %v, want context.Canceled", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func moved(a []int64, b []int64) int {
+  n := 0
+  for i := range a {
+    if a[i] != b[i] {
+      n++
+    }
+  }
+  return n
+}
+
+func balanced(t *testing.T, shards []int64, gids []int64) {
+  counts := map[int64]int{}
+  for _, gid := range gids {
+    counts[gid] = 0
+  }
+  for shard, gid := range shards {
+    if _, ok := counts[gid]; !ok {
+      t.Fatalf("shard %v -> invalid group %v", shard, gid)
+    }
+    counts[gid]++
+  }
+  min, max := len(shards), 0
+  for _, n := range counts {
+    if n < min {
+      min = n
+    }
+    if n > max {
+      max = n
+    }
+  }
+  if max > min + 1 {
+    t.Fatalf("unbalanced: %v", shards)
+  }
+}
+
+func layout(shards []int64, gids []int64) Config {
+  config := Config{}
+  config.Shards = shards
+  config.Groups = map[int64][]string{}
+  for _, gid := range gids {
+    config.Groups[gid] = []string{}
+  }
+  return config
+}
+
+func TestBalance(t *testing.T) {
+  fmt.Printf("Test: balance() spreads shards evenly ...\n")
+
+  none := make([]int64, NShards)
+  s1 := balance(layout(none, []int64{1}))
+  balanced(t, s1, []int64{1})
+  if moved(none, s1) != NShards {
+    t.Fatalf("first group got %v", s1)
+  }
+  if s := balance(layout(s1, []int64{})); moved(none, s) != 0 {
+    t.Fatalf("no groups, but shards assigned: %v", s)
+  }
+
+  // 10 shards over 3 groups: 4, 3, 3.
+  s3 := balance(layout(s1, []int64{1, 2, 3}))
+  balanced(t, s3, []int64{1, 2, 3})
+  if moved(s1, s3) != 6 {
+    t.Fatalf("two joins moved %v shards, want 6", moved(s1, s3))
+  }
+
+  // more groups than shards.
+  many := []int64{}
+  for gid := int64(1); gid <= NShards + 2; gid++ {
+    many = append(many, gid)
+  }
+  balanced(t, balance(layout(s3, many)), many)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: balance() moves the fewest shards ...\n")
+
+  s4 := balance(layout(s3, []int64{1, 2, 3, 4}))
+  balanced(t, s4, []int64{1, 2, 3, 4})
+  if moved(s3, s4) != 2 {
+    t.Fatalf("join moved %v shards, want 2", moved(s3, s4))
+  }
+  for i := range s3 {
+    if s4[i] != s3[i] && s4[i] != 4 {
+      t.Fatalf("join moved shard %v between old groups", i)
+    }
+  }
+
+  // the group that leaves had 2 or 3 shards; only those move.
+  left := 0
+  for _, gid := range s4 {
+    if gid == 2 {
+      left++
+    }
+  }
+  s5 := balance(layout(s4, []int64{1, 3, 4}))
+  balanced(t, s5, []int64{1, 3, 4})
+  if moved(s4, s5) != left {
+    t.Fatalf("leave moved %v shards, want %v", moved(s4, s5), left)
+  }
+
+  if moved(s5, balance(layout(s5, []int64{1, 3, 4}))) != 0 {
+    t.Fatalf("balanced shards moved")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: balance() is deterministic and keeps Move()s ...\n")
+
+  a := balance(layout(s5, []int64{4, 1, 3, 7}))
+  b := balance(layout(s5, []int64{7, 3, 1, 4}))
+  if moved(a, b) != 0 {
+    t.Fatalf("result depends on gids order: %v %v", a, b)
+  }
+
+  // swap two shards between groups, as Move() could; the
+  // groups stay balanced, so nothing moves back.
+  pinned := append([]int64{}, s5...)
+  i, j := 0, 0
+  for pinned[j] == pinned[i] {
+    j++
+  }
+  pinned[i], pinned[j] = pinned[j], pinned[i]
+  if moved(pinned, balance(layout(pinned, []int64{1, 3, 4}))) != 0 {
+    t.Fatalf("balanced Move()s undone")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSplit(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("split", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServerShards(kvh, i, 4)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Shard count chosen at start ...\n")
+
+  if c := ck.Query(-1); len(c.Shards) != 4 {
+    t.Fatalf("wanted 4 shards, got %v", len(c.Shards))
+  }
+  ck.Join(1, []string{"a"})
+  ck.Join(2, []string{"b"})
+  check(t, []int64{1, 2}, ck)
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Split doubles the shards in place ...\n")
+
+  c1 := ck.Query(-1)
+  ck.Split()
+  c2 := MakeClerk([]string{kvh[2]}).Query(-1)
+  if c2.Num != c1.Num + 1 || len(c2.Shards) != 8 {
+    t.Fatalf("wanted config %v with 8 shards, got %v with %v",
+             c1.Num + 1, c2.Num, len(c2.Shards))
+  }
+  // already balanced, so every key keeps its group.
+  for i := range c2.Shards {
+    if c2.Shards[i] != c1.Shards[i % 4] {
+      t.Fatalf("shard %v moved from %v to %v", i, c1.Shards[i % 4], c2.Shards[i])
+    }
+  }
+  if c := ck.Query(c1.Num); len(c.Shards) != 4 {
+    t.Fatalf("Split changed an old config")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Split of an uneven layout moves the fewest shards ...\n")
+
+  // 8 shards over 3 groups is 3/3/2, which doubles to
+  // 6/6/4 against 6/5/5, so exactly one shard moves.
+  ck.Join(3, []string{"c"})
+  check(t, []int64{1, 2, 3}, ck)
+  c3 := ck.Query(-1)
+  ck.Split()
+  check(t, []int64{1, 2, 3}, ck)
+  c4 := ck.Query(-1)
+  if len(c4.Shards) != 16 {
+    t.Fatalf("wanted 16 shards, got %v", len(c4.Shards))
+  }
+  nmoved := 0
+  for i := range c4.Shards {
+    if c4.Shards[i] != c3.Shards[i % 8] {
+      nmoved++
+    }
+  }
+  if nmoved != 1 {
+    t.Fatalf("Split moved %v shards, wanted 1", nmoved)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestPlacement(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: balance() follows weights ...\n")
+
+  c := layout(make([]int64, 8), []int64{1, 2})
+  c.Weights = map[int64]int{1: 1, 2: 3}
+  c.Shards = balance(c)
+  counts := map[int64]int{}
+  for _, gid := range c.Shards {
+    counts[gid]++
+  }
+  if counts[1] != 2 || counts[2] != 6 {
+    t.Fatalf("weights 1:3 gave %v", counts)
+  }
+
+  // 7 shards at 2:2:3 is 2, 2, 3.
+  // adding group 3 only takes shards from the others.
+  before := c.Shards
+  c = layout(c.Shards, []int64{1, 2, 3})
+  c.Weights = map[int64]int{1: 1, 2: 3, 3: 4}
+  c.Shards = balance(c)
+  counts = map[int64]int{}
+  for _, gid := range c.Shards {
+    counts[gid]++
+  }
+  if counts[1] != 1 || counts[2] != 3 || counts[3] != 4 {
+    t.Fatalf("weights 1:3:4 gave %v", counts)
+  }
+  if moved(before, c.Shards) != 4 {
+    t.Fatalf("join moved %v shards, want 4", moved(before, c.Shards))
+  }
+
+  // 7 shards at 2:2:3 is 2, 2, 3.
+  c = layout(make([]int64, 7), []int64{1, 2, 3})
+  c.Weights = map[int64]int{1: 2, 2: 2, 3: 3}
+  c.Shards = balance(c)
+  counts = map[int64]int{}
+  for _, gid := range c.Shards {
+    counts[gid]++
+  }
+  if counts[1] != 2 || counts[2] != 2 || counts[3] != 3 {
+    t.Fatalf("weights 2:2:3 gave %v", counts)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: balance() keeps anti-affinity sets apart ...\n")
+
+  c = layout(make([]int64, 6), []int64{1, 2, 3})
+  c.Zones = map[int64]string{1: "a", 2: "a", 3: "b"}
+  c.AntiAffinity = [][]int{{0, 1}, {2, 3, 4}}
+  c.Shards = balance(c)
+  if c.Shards[0] == c.Shards[1] {
+    t.Fatalf("shards 0 and 1 on one group: %v", c.Shards)
+  }
+  if c.Zones[c.Shards[0]] == c.Zones[c.Shards[1]] {
+    t.Fatalf("shards 0 and 1 in one zone: %v", c.Shards)
+  }
+  if c.Shards[2] == c.Shards[3] || c.Shards[3] == c.Shards[4] || c.Shards[2] == c.Shards[4] {
+    t.Fatalf("shards 2, 3 and 4 share a group: %v", c.Shards)
+  }
+
+  // a clash already in place is undone.
+  c.Shards = []int64{1, 1, 2, 2, 3, 3}
+  c.AntiAffinity = [][]int{{0, 1}}
+  c.Shards = balance(c)
+  balanced(t, c.Shards, []int64{1, 2, 3})
+  if c.Shards[0] == c.Shards[1] {
+    t.Fatalf("clash not undone: %v", c.Shards)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("placement", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServerShards(kvh, i, 12)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Query returns weights and zones ...\n")
+
+  ck.JoinWeighted(1, []string{"a"}, 1, "east")
+  ck.JoinWeighted(2, []string{"b"}, 2, "west")
+  ck.SetAntiAffinity([][]int{{0, 1, 2}})
+  cf := ck.Query(-1)
+  if cf.Weights[1] != 1 || cf.Weights[2] != 2 {
+    t.Fatalf("wrong weights %v", cf.Weights)
+  }
+  if cf.Zones[1] != "east" || cf.Zones[2] != "west" {
+    t.Fatalf("wrong zones %v", cf.Zones)
+  }
+  counts = map[int64]int{}
+  for _, gid := range cf.Shards {
+    counts[gid]++
+  }
+  if counts[1] != 4 || counts[2] != 8 {
+    t.Fatalf("weights 1:2 gave %v", counts)
+  }
+
+  ck.Join(3, []string{"c"})
+  cf = ck.Query(-1)
+  if cf.Weights[3] != 1 {
+    t.Fatalf("plain Join got weight %v", cf.Weights[3])
+  }
+  if cf.Shards[0] == cf.Shards[1] || cf.Shards[1] == cf.Shards[2] || cf.Shards[0] == cf.Shards[2] {
+    t.Fatalf("anti-affinity set shares a group: %v", cf.Shards)
+  }
+
+  ck.Leave(2)
+  cf = ck.Query(-1)
+  if _, ok := cf.Weights[2]; ok {
+    t.Fatalf("weight kept after Leave")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// report rate requests/second on each shard in hot, and 1 on
+// the rest, as the groups owning them in the latest config.
+//
+func reportLoads(ck *Clerk, hot map[int]bool, rate float64) {
+  c := ck.Query(-1)
+  loads := map[int64][]ShardLoad{}
+  for shard, gid := range c.Shards {
+    load := ShardLoad{shard, 1, 100}
+    if hot[shard] {
+      load.Rate = rate
+    }
+    loads[gid] = append(loads[gid], load)
+  }
+  for gid, l := range loads {
+    ck.Report(gid, strconv.FormatInt(gid, 10), c.Num, l)
+  }
+}
+
+func TestAutoBalance(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: pickMove() evens out the hot group ...\n")
+
+  c := layout([]int64{1, 1, 2, 2, 3, 3}, []int64{1, 2, 3})
+  loads := map[int]ShardLoad{
+    0: {0, 100, 500}, 1: {1, 100, 50}, 2: {2, 5, 0}, 3: {3, 5, 0}, 4: {4, 1, 0}, 5: {5, 1, 0},
+  }
+  move, ok := pickMove(c, loads, 1)
+  if !ok || move.GID != 3 || move.Shard != 1 {
+    t.Fatalf("wanted shard 1 to group 3, got %v %v", move, ok)
+  }
+  c.AntiAffinity = [][]int{{1, 4}}
+  if move, _ = pickMove(c, loads, 1); move.Shard != 0 {
+    t.Fatalf("anti-affinity ignored: %v", move)
+  }
+  loads[0] = ShardLoad{0, 300, 0}
+  loads[1] = ShardLoad{1, 0, 0}
+  if move, ok = pickMove(c, loads, 1); ok {
+    t.Fatalf("a move that can't help: %v", move)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  const nservers = 3
+  var sma []*ShardMaster = make([]*ShardMaster, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(sma)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("auto", i)
+  }
+  for i := 0; i < nservers; i++ {
+    sma[i] = StartServerShards(kvh, i, 6)
+  }
+
+  ck := MakeClerk(kvh)
+  ck.Join(1, []string{"a"})
+  ck.Join(2, []string{"b"})
+  ck.Join(3, []string{"c"})
+
+  // both of one group's shards get most of the requests.
+  c = ck.Query(-1)
+  hot := map[int]bool{}
+  for shard, gid := range c.Shards {
+    if gid == c.Shards[0] {
+      hot[shard] = true
+    }
+  }
+
+  fmt.Printf("Test: Dry run records moves at a limited rate ...\n")
+
+  for i := 0; i < nservers; i++ {
+    sma[i].SetAutoBalance(AutoBalance{50 * time.Millisecond, 1.5, 2, 400 * time.Millisecond, true})
+  }
+  for i := 0; i < 20; i++ {
+    reportLoads(ck, hot, 100)
+    time.Sleep(50 * time.Millisecond)
+  }
+  if c1 := ck.Query(-1); c1.Num != c.Num {
+    t.Fatalf("dry run changed the config")
+  }
+  n := len(sma[0].DryRunMoves())
+  if n < 1 || n > 3 {
+    t.Fatalf("%v dry run moves in 1s, 400ms apart", n)
+  }
+  if m := sma[0].DryRunMoves()[0]; !hot[m.Shard] || m.GID == c.Shards[0] {
+    t.Fatalf("dry run moved the wrong shard: %v", m)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: A persistently hot group sheds a shard ...\n")
+
+  for i := 0; i < nservers; i++ {
+    sma[i].SetAutoBalance(AutoBalance{50 * time.Millisecond, 1.5, 2, 400 * time.Millisecond, false})
+  }
+  var c2 Config
+  for i := 0; i < 40; i++ {
+    reportLoads(ck, hot, 100)
+    time.Sleep(50 * time.Millisecond)
+    if c2 = ck.Query(-1); c2.Num != c.Num {
+      break
+    }
+  }
+  if c2.Num != c.Num + 1 || moved(c.Shards, c2.Shards) != 1 {
+    t.Fatalf("wanted one move, got %v -> %v", c.Shards, c2.Shards)
+  }
+
+  // now balanced enough: no more moves.
+  for i := 0; i < 20; i++ {
+    reportLoads(ck, hot, 100)
+    time.Sleep(50 * time.Millisecond)
+  }
+  if c3 := ck.Query(-1); c3.Num != c2.Num {
+    t.Fatalf("moved again after balancing: %v -> %v", c2.Shards, c3.Shards)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}